@@ -19,23 +19,92 @@ package v1
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
 
+	"github.com/sirupsen/logrus"
+
+	"github.com/nuts-foundation/hashicorp-vault-proxy/audit"
 	"github.com/nuts-foundation/hashicorp-vault-proxy/vault"
 )
 
 type Wrapper struct {
-	vault vault.Storage
+	vault  vault.Storage
+	config Config
+}
+
+// Config contains the settings of the API.
+type Config struct {
+	// TokenTTLWarningThreshold is the remaining time-to-live of the Vault token below which the health check reports a warning.
+	TokenTTLWarningThreshold time.Duration
+	// TokenUsesWarningThreshold is the number of remaining uses of the Vault token at or below which the health check reports a warning.
+	TokenUsesWarningThreshold int
+	// CheckCapabilities makes the health check verify the token has the capabilities required to use the storage.
+	CheckCapabilities bool
+	// Auditor records the operations on the secrets, if set.
+	Auditor Auditor
+}
+
+// Auditor records the operations on the secrets in the audit log.
+type Auditor interface {
+	Record(ctx context.Context, operation string, key string, result string) error
+}
+
+// DefaultConfig returns the default settings of the API.
+func DefaultConfig() Config {
+	return Config{
+		TokenTTLWarningThreshold:  10 * time.Minute,
+		TokenUsesWarningThreshold: 10,
+	}
 }
 
 const backend = "vault"
 
-func NewWrapper(vault vault.Storage) Wrapper {
-	return Wrapper{vault: vault}
+func NewWrapper(vault vault.Storage, config Config) Wrapper {
+	return Wrapper{vault: vault, config: config}
+}
+
+// audit records the outcome of the operation on the given key (empty for operations on all keys) in the audit log.
+// Failing to record it doesn't fail the operation, which has already been performed.
+func (w Wrapper) audit(ctx context.Context, operation string, key string, result string) {
+	record(ctx, w.config.Auditor, operation, key, result)
+}
+
+// record records the outcome of the operation in the audit log of the auditor, if set.
+func record(ctx context.Context, auditor Auditor, operation string, key string, result string) {
+	if auditor == nil {
+		return
+	}
+	if err := auditor.Record(ctx, operation, key, result); err != nil {
+		logrus.WithError(err).Errorf("Unable to record %s operation in the audit log", operation)
+	}
+}
+
+// auditResult returns the result of an operation as recorded in the audit log.
+func auditResult(err error) string {
+	switch {
+	case err == nil:
+		return audit.ResultSuccess
+	case errors.Is(err, vault.ErrStale):
+		return audit.ResultStale
+	case errors.Is(err, vault.ErrNotFound):
+		return audit.ResultNotFound
+	case errors.Is(err, vault.ErrKeyAlreadyExists):
+		return audit.ResultConflict
+	default:
+		return audit.ResultError
+	}
 }
 
 func (w Wrapper) DeleteSecret(ctx context.Context, request DeleteSecretRequestObject) (DeleteSecretResponseObject, error) {
-	err := w.vault.DeleteSecret(request.Key)
+	err := w.vault.DeleteSecret(ctx, request.Key)
+	w.audit(ctx, audit.OperationDelete, request.Key, auditResult(err))
 	if err != nil {
+		if response, ok := storageErrorResponse(err); ok {
+			return response, nil
+		}
 		if err == vault.ErrNotFound {
 			return DeleteSecret404JSONResponse{
 				Backend: backend,
@@ -50,7 +119,11 @@ func (w Wrapper) DeleteSecret(ctx context.Context, request DeleteSecretRequestOb
 }
 
 func (w Wrapper) LookupSecret(ctx context.Context, request LookupSecretRequestObject) (LookupSecretResponseObject, error) {
-	key, err := w.vault.GetSecret(string(request.Key))
+	key, err := w.vault.GetSecret(ctx, string(request.Key))
+	w.audit(ctx, audit.OperationLookup, string(request.Key), auditResult(err))
+	if errors.Is(err, vault.ErrStale) {
+		return staleSecretResponse{SecretResponse: SecretResponse{Secret: Secret(key)}}, nil
+	}
 	if err != nil {
 		if err == vault.ErrNotFound {
 			return LookupSecret404JSONResponse(ErrorResponse{
@@ -60,6 +133,9 @@ func (w Wrapper) LookupSecret(ctx context.Context, request LookupSecretRequestOb
 				Title:   "Secret not found",
 			}), nil
 		}
+		if response, ok := storageErrorResponse(err); ok {
+			return response, nil
+		}
 		return LookupSecret500JSONResponse(ErrorResponse{
 			Backend: backend,
 			Detail:  err.Error(),
@@ -71,8 +147,12 @@ func (w Wrapper) LookupSecret(ctx context.Context, request LookupSecretRequestOb
 }
 
 func (w Wrapper) ListKeys(ctx context.Context, request ListKeysRequestObject) (ListKeysResponseObject, error) {
-	keys, err := w.vault.ListKeys()
+	keys, err := w.vault.ListKeys(ctx)
+	w.audit(ctx, audit.OperationList, "", auditResult(err))
 	if err != nil {
+		if response, ok := storageErrorResponse(err); ok {
+			return response, nil
+		}
 		return ListKeys500JSONResponse(ErrorResponse{
 			Backend: backend,
 			Detail:  err.Error(),
@@ -89,6 +169,7 @@ func (w Wrapper) ListKeys(ctx context.Context, request ListKeysRequestObject) (L
 
 func (w Wrapper) StoreSecret(ctx context.Context, request StoreSecretRequestObject) (StoreSecretResponseObject, error) {
 	if request.Body.Secret == "" {
+		w.audit(ctx, audit.OperationStore, request.Key, audit.ResultInvalid)
 		return StoreSecret400JSONResponse(ErrorResponse{
 			Backend: backend,
 			Detail:  "Secret is required",
@@ -96,7 +177,8 @@ func (w Wrapper) StoreSecret(ctx context.Context, request StoreSecretRequestObje
 			Title:   "Bad request",
 		}), nil
 	}
-	err := w.vault.StoreSecret(request.Key, []byte(request.Body.Secret))
+	err := w.vault.StoreSecret(ctx, request.Key, []byte(request.Body.Secret))
+	w.audit(ctx, audit.OperationStore, request.Key, auditResult(err))
 	if err != nil {
 		if err == vault.ErrKeyAlreadyExists {
 			return StoreSecret409JSONResponse(ErrorResponse{
@@ -106,6 +188,9 @@ func (w Wrapper) StoreSecret(ctx context.Context, request StoreSecretRequestObje
 				Title:   "Key already exists",
 			}), nil
 		}
+		if response, ok := storageErrorResponse(err); ok {
+			return response, nil
+		}
 		return StoreSecret500JSONResponse(ErrorResponse{
 			Backend: backend,
 			Detail:  err.Error(),
@@ -113,7 +198,7 @@ func (w Wrapper) StoreSecret(ctx context.Context, request StoreSecretRequestObje
 			Title:   "Could not store secret",
 		}), nil
 	}
-	result, err := w.vault.GetSecret(string(request.Key))
+	result, err := w.vault.GetSecret(ctx, string(request.Key))
 	if err != nil {
 		return StoreSecret400JSONResponse(ErrorResponse{
 			Backend: backend,
@@ -126,9 +211,80 @@ func (w Wrapper) StoreSecret(ctx context.Context, request StoreSecretRequestObje
 }
 
 func (w Wrapper) HealthCheck(ctx context.Context, _ HealthCheckRequestObject) (HealthCheckResponseObject, error) {
-	if err := w.vault.Ping(); err != nil {
-		errMessage := err.Error()
-		return HealthCheck503JSONResponse{Status: Fail, Details: &errMessage}, nil
+	response, status := w.checkHealth(ctx)
+	recordHealth(response, status)
+	return response, nil
+}
+
+// checkHealth returns the health check response and the status of the storage it is based on,
+// which is nil if the status couldn't be determined.
+func (w Wrapper) checkHealth(ctx context.Context) (HealthCheckResponseObject, *vault.Status) {
+	status, err := w.vault.Ping(ctx)
+	var pinged *vault.Status
+	if err == nil {
+		pinged = &status
+	}
+	var details []string
+	if status.VaultState != "" {
+		details = append(details, "vault state: "+status.VaultState)
+	}
+	if status.CircuitBreaker != "" && status.CircuitBreaker != vault.CircuitBreakerClosed {
+		details = append(details, "circuit breaker: "+status.CircuitBreaker)
+	}
+	if status.Limiter != nil {
+		details = append(details, fmt.Sprintf("vault requests: %d active, %d queued", status.Limiter.Active, status.Limiter.Queued))
+	}
+	if err == nil && w.config.CheckCapabilities {
+		err = w.checkCapabilities(ctx)
+	}
+	if err != nil {
+		return HealthCheck503JSONResponse{Status: Fail, Details: joinDetails(append(details, err.Error()))}, pinged
+	}
+	if status.TokenTTL > 0 {
+		details = append(details, fmt.Sprintf("token expires in %s", status.TokenTTL))
+	} else {
+		details = append(details, "token does not expire")
+	}
+	warnings := w.tokenWarnings(status)
+	if status.VaultState == vault.VaultStateStandby {
+		warnings = append(warnings, "vault is a standby node, requests are forwarded to the active node")
+	}
+	if len(warnings) > 0 {
+		return HealthCheck200JSONResponse{Status: Warn, Details: joinDetails(append(details, warnings...))}, &status
+	}
+	return HealthCheck200JSONResponse{Status: Pass, Details: joinDetails(details)}, &status
+}
+
+// checkCapabilities returns an error if the token lacks capabilities required to use the storage.
+func (w Wrapper) checkCapabilities(ctx context.Context) error {
+	missing, err := w.vault.MissingCapabilities(ctx)
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("token is missing capabilities: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func joinDetails(details []string) *string {
+	joined := strings.Join(details, "; ")
+	return &joined
+}
+
+// tokenWarnings returns the concerns about the Vault token that could lead to an outage if not addressed.
+func (w Wrapper) tokenWarnings(status vault.Status) []string {
+	var warnings []string
+	if status.TokenTTL > 0 {
+		if status.TokenTTL < w.config.TokenTTLWarningThreshold {
+			warnings = append(warnings, fmt.Sprintf("token expires within %s", w.config.TokenTTLWarningThreshold))
+		}
+		if !status.TokenRenewable {
+			warnings = append(warnings, "token is not renewable")
+		}
+	}
+	if status.TokenRemainingUses > 0 && status.TokenRemainingUses <= w.config.TokenUsesWarningThreshold {
+		warnings = append(warnings, fmt.Sprintf("token has %d uses left", status.TokenRemainingUses))
 	}
-	return HealthCheck200JSONResponse{Status: Pass}, nil
+	return warnings
 }
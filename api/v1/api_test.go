@@ -0,0 +1,313 @@
+/*
+ * Copyright (C) 2023 Nuts community
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package v1
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nuts-foundation/hashicorp-vault-proxy/vault"
+)
+
+// mockStorage is a vault.Storage which returns the configured results.
+type mockStorage struct {
+	status              vault.Status
+	err                 error
+	secret              []byte
+	keys                []string
+	missingCapabilities []string
+	capabilitiesErr     error
+}
+
+func (m mockStorage) Ping(_ context.Context) (vault.Status, error) {
+	return m.status, m.err
+}
+
+func (m mockStorage) GetSecret(_ context.Context, _ string) ([]byte, error) {
+	return m.secret, m.err
+}
+
+func (m mockStorage) StoreSecret(_ context.Context, _ string, _ []byte) error {
+	return m.err
+}
+
+func (m mockStorage) DeleteSecret(_ context.Context, _ string) error {
+	return m.err
+}
+
+func (m mockStorage) ListKeys(_ context.Context) ([]string, error) {
+	return m.keys, m.err
+}
+
+func (m mockStorage) MissingCapabilities(_ context.Context) ([]string, error) {
+	return m.missingCapabilities, m.capabilitiesErr
+}
+
+func TestWrapper_HealthCheck(t *testing.T) {
+	healthCheck := func(t *testing.T, storage mockStorage) (ServiceStatus, bool) {
+		config := DefaultConfig()
+		config.CheckCapabilities = true
+		response, err := NewWrapper(storage, config).HealthCheck(context.Background(), HealthCheckRequestObject{})
+		require.NoError(t, err)
+		switch r := response.(type) {
+		case HealthCheck200JSONResponse:
+			return ServiceStatus(r), true
+		case HealthCheck503JSONResponse:
+			return ServiceStatus(r), false
+		}
+		t.Fatalf("unexpected response: %T", response)
+		return ServiceStatus{}, false
+	}
+
+	t.Run("pass", func(t *testing.T) {
+		status, ok := healthCheck(t, mockStorage{status: vault.Status{TokenTTL: time.Hour, TokenRenewable: true}})
+		assert.True(t, ok)
+		assert.Equal(t, Pass, status.Status)
+		assert.Equal(t, "token expires in 1h0m0s", *status.Details)
+	})
+	t.Run("pass - token does not expire", func(t *testing.T) {
+		status, ok := healthCheck(t, mockStorage{})
+		assert.True(t, ok)
+		assert.Equal(t, Pass, status.Status)
+		assert.Equal(t, "token does not expire", *status.Details)
+	})
+	t.Run("warn - token expires soon", func(t *testing.T) {
+		status, ok := healthCheck(t, mockStorage{status: vault.Status{TokenTTL: time.Minute, TokenRenewable: true}})
+		assert.True(t, ok)
+		assert.Equal(t, Warn, status.Status)
+		assert.Equal(t, "token expires in 1m0s; token expires within 10m0s", *status.Details)
+	})
+	t.Run("warn - token not renewable", func(t *testing.T) {
+		status, ok := healthCheck(t, mockStorage{status: vault.Status{TokenTTL: time.Hour}})
+		assert.True(t, ok)
+		assert.Equal(t, Warn, status.Status)
+		assert.Equal(t, "token expires in 1h0m0s; token is not renewable", *status.Details)
+	})
+	t.Run("warn - token uses nearly exhausted", func(t *testing.T) {
+		status, ok := healthCheck(t, mockStorage{status: vault.Status{TokenRemainingUses: 3}})
+		assert.True(t, ok)
+		assert.Equal(t, Warn, status.Status)
+		assert.Equal(t, "token does not expire; token has 3 uses left", *status.Details)
+	})
+	t.Run("fail - missing capabilities", func(t *testing.T) {
+		status, ok := healthCheck(t, mockStorage{missingCapabilities: []string{"create on kv/key", "list on kv/"}})
+		assert.False(t, ok)
+		assert.Equal(t, Fail, status.Status)
+		assert.Equal(t, "token is missing capabilities: create on kv/key, list on kv/", *status.Details)
+	})
+	t.Run("fail - unable to check capabilities", func(t *testing.T) {
+		status, ok := healthCheck(t, mockStorage{capabilitiesErr: errors.New("permission denied")})
+		assert.False(t, ok)
+		assert.Equal(t, Fail, status.Status)
+		assert.Equal(t, "permission denied", *status.Details)
+	})
+	t.Run("pass - vault state", func(t *testing.T) {
+		status, ok := healthCheck(t, mockStorage{status: vault.Status{VaultState: vault.VaultStatePerformanceStandby}})
+		assert.True(t, ok)
+		assert.Equal(t, Pass, status.Status)
+		assert.Equal(t, "vault state: performance standby; token does not expire", *status.Details)
+	})
+	t.Run("warn - standby", func(t *testing.T) {
+		status, ok := healthCheck(t, mockStorage{status: vault.Status{VaultState: vault.VaultStateStandby}})
+		assert.True(t, ok)
+		assert.Equal(t, Warn, status.Status)
+		assert.Equal(t, "vault state: standby; token does not expire; vault is a standby node, requests are forwarded to the active node", *status.Details)
+	})
+	t.Run("fail - sealed", func(t *testing.T) {
+		status, ok := healthCheck(t, mockStorage{status: vault.Status{VaultState: vault.VaultStateSealed}, err: vault.ErrSealed})
+		assert.False(t, ok)
+		assert.Equal(t, Fail, status.Status)
+		assert.Equal(t, "vault state: sealed; vault is sealed", *status.Details)
+	})
+	t.Run("fail - circuit breaker open", func(t *testing.T) {
+		err := fmt.Errorf("unable to connect to Vault: %w: %w", vault.ErrUnavailable, vault.ErrCircuitOpen)
+		status, ok := healthCheck(t, mockStorage{status: vault.Status{VaultState: vault.VaultStateActive, CircuitBreaker: vault.CircuitBreakerOpen}, err: err})
+		assert.False(t, ok)
+		assert.Equal(t, Fail, status.Status)
+		assert.Equal(t, "vault state: active; circuit breaker: open; unable to connect to Vault: vault is unavailable: circuit breaker is open", *status.Details)
+	})
+	t.Run("pass - circuit breaker closed", func(t *testing.T) {
+		status, ok := healthCheck(t, mockStorage{status: vault.Status{CircuitBreaker: vault.CircuitBreakerClosed}})
+		assert.True(t, ok)
+		assert.Equal(t, Pass, status.Status)
+		assert.Equal(t, "token does not expire", *status.Details)
+	})
+	t.Run("pass - concurrent requests", func(t *testing.T) {
+		status, ok := healthCheck(t, mockStorage{status: vault.Status{Limiter: &vault.LimiterStats{Active: 8, Queued: 3}}})
+		assert.True(t, ok)
+		assert.Equal(t, Pass, status.Status)
+		assert.Equal(t, "vault requests: 8 active, 3 queued; token does not expire", *status.Details)
+	})
+	t.Run("fail", func(t *testing.T) {
+		status, ok := healthCheck(t, mockStorage{err: errors.New("vault is down")})
+		assert.False(t, ok)
+		assert.Equal(t, Fail, status.Status)
+		assert.Equal(t, "vault is down", *status.Details)
+	})
+}
+
+func TestWrapper_storageErrors(t *testing.T) {
+	testCases := []struct {
+		err        error
+		status     int
+		title      string
+		retryAfter int
+	}{
+		{err: vault.ErrPermissionDenied, status: http.StatusForbidden, title: "Permission denied by Vault"},
+		{err: vault.ErrInvalidPath, status: http.StatusBadRequest, title: "Invalid secret path"},
+		{err: vault.ErrRateLimited, status: http.StatusTooManyRequests, title: "Rate limited by Vault", retryAfter: 1},
+		{err: vault.ErrBusy, status: http.StatusTooManyRequests, title: "Too many concurrent requests to Vault", retryAfter: 1},
+		{err: vault.ErrTimeout, status: http.StatusGatewayTimeout, title: "Vault request timed out"},
+		{err: vault.ErrSealed, status: http.StatusServiceUnavailable, title: "Vault is sealed"},
+		{err: vault.ErrUnavailable, status: http.StatusServiceUnavailable, title: "Vault is unavailable"},
+	}
+	for _, testCase := range testCases {
+		err := fmt.Errorf("unable to read key from vault: %w", testCase.err)
+		expected := errorResponse{ErrorResponse: ErrorResponse{Backend: backend, Detail: err.Error(), Status: testCase.status, Title: testCase.title}, retryAfter: testCase.retryAfter}
+		wrapper := NewWrapper(mockStorage{err: err}, DefaultConfig())
+
+		t.Run(testCase.title, func(t *testing.T) {
+			t.Run("LookupSecret", func(t *testing.T) {
+				response, err := wrapper.LookupSecret(context.Background(), LookupSecretRequestObject{Key: "key"})
+				require.NoError(t, err)
+				assert.Equal(t, expected, response)
+
+				recorder := httptest.NewRecorder()
+				require.NoError(t, response.VisitLookupSecretResponse(recorder))
+				assert.Equal(t, testCase.status, recorder.Code)
+				assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+				assert.Contains(t, recorder.Body.String(), `"title":"`+testCase.title+`"`)
+				if testCase.retryAfter > 0 {
+					assert.Equal(t, fmt.Sprint(testCase.retryAfter), recorder.Header().Get("Retry-After"))
+				} else {
+					assert.Empty(t, recorder.Header().Get("Retry-After"))
+				}
+			})
+			t.Run("StoreSecret", func(t *testing.T) {
+				response, err := wrapper.StoreSecret(context.Background(), StoreSecretRequestObject{Key: "key", Body: &StoreSecretRequest{Secret: "secret"}})
+				require.NoError(t, err)
+				assert.Equal(t, expected, response)
+			})
+			t.Run("DeleteSecret", func(t *testing.T) {
+				response, err := wrapper.DeleteSecret(context.Background(), DeleteSecretRequestObject{Key: "key"})
+				require.NoError(t, err)
+				assert.Equal(t, expected, response)
+			})
+			t.Run("ListKeys", func(t *testing.T) {
+				response, err := wrapper.ListKeys(context.Background(), ListKeysRequestObject{})
+				require.NoError(t, err)
+				assert.Equal(t, expected, response)
+			})
+		})
+	}
+
+	t.Run("other errors", func(t *testing.T) {
+		response, err := NewWrapper(mockStorage{err: errors.New("failure")}, DefaultConfig()).LookupSecret(context.Background(), LookupSecretRequestObject{Key: "key"})
+		require.NoError(t, err)
+		assert.IsType(t, LookupSecret500JSONResponse{}, response)
+	})
+}
+
+func TestWrapper_LookupSecret(t *testing.T) {
+	t.Run("ok", func(t *testing.T) {
+		response, err := NewWrapper(mockStorage{secret: []byte("secret")}, DefaultConfig()).LookupSecret(context.Background(), LookupSecretRequestObject{Key: "key"})
+		require.NoError(t, err)
+
+		recorder := httptest.NewRecorder()
+		require.NoError(t, response.VisitLookupSecretResponse(recorder))
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Empty(t, recorder.Header().Get("Warning"))
+	})
+	t.Run("stale", func(t *testing.T) {
+		err := fmt.Errorf("%w: %w", vault.ErrStale, vault.ErrSealed)
+		response, err := NewWrapper(mockStorage{secret: []byte("secret"), err: err}, DefaultConfig()).LookupSecret(context.Background(), LookupSecretRequestObject{Key: "key"})
+		require.NoError(t, err)
+
+		recorder := httptest.NewRecorder()
+		require.NoError(t, response.VisitLookupSecretResponse(recorder))
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, `110 - "Response is Stale"`, recorder.Header().Get("Warning"))
+		assert.JSONEq(t, `{"secret":"secret"}`, recorder.Body.String())
+	})
+}
+
+// recordingAuditor is an Auditor which keeps the recorded operations.
+type recordingAuditor struct {
+	records *[]string
+	err     error
+}
+
+func (a recordingAuditor) Record(_ context.Context, operation string, key string, result string) error {
+	*a.records = append(*a.records, fmt.Sprintf("%s %s: %s", operation, key, result))
+	return a.err
+}
+
+func TestWrapper_audit(t *testing.T) {
+	ctx := context.Background()
+	newWrapper := func(storage mockStorage, auditErr error) (Wrapper, *[]string) {
+		records := &[]string{}
+		config := DefaultConfig()
+		config.Auditor = recordingAuditor{records: records, err: auditErr}
+		return NewWrapper(storage, config), records
+	}
+
+	t.Run("records operations", func(t *testing.T) {
+		wrapper, records := newWrapper(mockStorage{secret: []byte("secret")}, nil)
+
+		_, _ = wrapper.LookupSecret(ctx, LookupSecretRequestObject{Key: "key"})
+		_, _ = wrapper.StoreSecret(ctx, StoreSecretRequestObject{Key: "key", Body: &StoreSecretRequest{Secret: "secret"}})
+		_, _ = wrapper.StoreSecret(ctx, StoreSecretRequestObject{Key: "key", Body: &StoreSecretRequest{}})
+		_, _ = wrapper.DeleteSecret(ctx, DeleteSecretRequestObject{Key: "key"})
+		_, _ = wrapper.ListKeys(ctx, ListKeysRequestObject{})
+		_, _ = wrapper.HealthCheck(ctx, HealthCheckRequestObject{})
+
+		assert.Equal(t, []string{"lookup key: success", "store key: success", "store key: invalid", "delete key: success", "list : success"}, *records)
+	})
+	t.Run("records results", func(t *testing.T) {
+		results := map[error]string{
+			vault.ErrNotFound:         "not_found",
+			vault.ErrKeyAlreadyExists: "conflict",
+			fmt.Errorf("%w: %w", vault.ErrStale, vault.ErrSealed): "stale",
+			vault.ErrUnavailable: "error",
+		}
+		for err, result := range results {
+			wrapper, records := newWrapper(mockStorage{err: err}, nil)
+
+			_, _ = wrapper.LookupSecret(ctx, LookupSecretRequestObject{Key: "key"})
+
+			assert.Equal(t, []string{"lookup key: " + result}, *records)
+		}
+	})
+	t.Run("failing to record doesn't fail the operation", func(t *testing.T) {
+		wrapper, records := newWrapper(mockStorage{secret: []byte("secret")}, errors.New("disk full"))
+
+		response, err := wrapper.LookupSecret(ctx, LookupSecretRequestObject{Key: "key"})
+
+		require.NoError(t, err)
+		assert.IsType(t, LookupSecret200JSONResponse{}, response)
+		assert.Len(t, *records, 1)
+	})
+}
@@ -0,0 +1,109 @@
+/*
+ * Copyright (C) 2023 Nuts community
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package v1
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+
+	"github.com/nuts-foundation/hashicorp-vault-proxy/audit"
+)
+
+// healthPath is the path of the health check, which may be exempted from authentication.
+const healthPath = "/health"
+
+// TokenVerifier verifies bearer tokens, returning the name of the client the token was issued to.
+type TokenVerifier interface {
+	Verify(token string) (string, bool)
+}
+
+// BearerAuth returns the echo middleware rejecting requests without a valid bearer token with 401 Unauthorized.
+// The health check is open to unauthenticated requests unless protectHealth is set.
+// The name of the client is recorded in the request context as client of the audit log.
+// Rejected operations on the secrets are recorded in the audit log of the auditor, if set.
+func BearerAuth(tokens TokenVerifier, protectHealth bool, auditor Auditor) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if !protectHealth && c.Path() == healthPath {
+				return next(c)
+			}
+			token, ok := bearerToken(c.Request())
+			if !ok {
+				auditUnauthorized(c, auditor)
+				return unauthorized(c, "Missing bearer token")
+			}
+			name, ok := tokens.Verify(token)
+			if !ok {
+				logrus.WithField("remote_ip", c.RealIP()).Warn("Rejected request with invalid bearer token")
+				auditUnauthorized(c, auditor)
+				return unauthorized(c, "Invalid bearer token")
+			}
+			request := c.Request()
+			ctx := audit.WithClient(request.Context(), audit.Client{ID: name, RemoteIP: c.RealIP()})
+			c.SetRequest(request.WithContext(ctx))
+			return next(c)
+		}
+	}
+}
+
+// auditUnauthorized records the rejected operation of the request in the audit log, unless it isn't an operation on the secrets.
+func auditUnauthorized(c echo.Context, auditor Auditor) {
+	var operation string
+	switch c.Request().Method + " " + c.Path() {
+	case http.MethodGet + " /secrets":
+		operation = audit.OperationList
+	case http.MethodGet + " /secrets/:key":
+		operation = audit.OperationLookup
+	case http.MethodPost + " /secrets/:key":
+		operation = audit.OperationStore
+	case http.MethodDelete + " /secrets/:key":
+		operation = audit.OperationDelete
+	default:
+		return
+	}
+	// like the handlers, record the unescaped key
+	key := c.Param("key")
+	if unescaped, err := url.PathUnescape(key); err == nil {
+		key = unescaped
+	}
+	record(c.Request().Context(), auditor, operation, key, audit.ResultUnauthorized)
+}
+
+// bearerToken returns the token of the Authorization header, if it contains a bearer token.
+func bearerToken(request *http.Request) (string, bool) {
+	scheme, token, found := strings.Cut(request.Header.Get(echo.HeaderAuthorization), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+func unauthorized(c echo.Context, detail string) error {
+	c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+	return c.JSON(http.StatusUnauthorized, ErrorResponse{
+		Backend: backend,
+		Detail:  detail,
+		Status:  http.StatusUnauthorized,
+		Title:   "Unauthorized",
+	})
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright (C) 2023 Nuts community
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package v1
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/nuts-foundation/hashicorp-vault-proxy/audit"
+)
+
+// staticTokens is a TokenVerifier accepting the tokens in the map, by name.
+type staticTokens map[string]string
+
+func (s staticTokens) Verify(token string) (string, bool) {
+	name, ok := s[token]
+	return name, ok
+}
+
+func TestBearerAuth(t *testing.T) {
+	newServer := func(protectHealth bool) (*echo.Echo, *audit.Client) {
+		client := &audit.Client{}
+		e := echo.New()
+		e.Use(BearerAuth(staticTokens{"token": "node"}, protectHealth, nil))
+		handler := func(c echo.Context) error {
+			*client = audit.ClientFromContext(c.Request().Context())
+			return c.NoContent(http.StatusNoContent)
+		}
+		e.GET("/secrets/:key", handler)
+		e.GET("/health", handler)
+		return e, client
+	}
+	request := func(e *echo.Echo, path string, authorization string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		recorder := httptest.NewRecorder()
+		e.ServeHTTP(recorder, r)
+		return recorder
+	}
+
+	t.Run("valid token", func(t *testing.T) {
+		e, client := newServer(false)
+
+		response := request(e, "/secrets/key", "Bearer token")
+
+		assert.Equal(t, http.StatusNoContent, response.Code)
+		assert.Equal(t, audit.Client{ID: "node", RemoteIP: "10.0.0.1"}, *client)
+	})
+	unauthorized := map[string]struct {
+		authorization string
+		detail        string
+	}{
+		"missing token": {"", "Missing bearer token"},
+		"other scheme":  {"Basic dG9rZW46", "Missing bearer token"},
+		"empty token":   {"Bearer ", "Missing bearer token"},
+		"invalid token": {"Bearer other", "Invalid bearer token"},
+	}
+	for name, testCase := range unauthorized {
+		t.Run(name, func(t *testing.T) {
+			e, _ := newServer(false)
+
+			response := request(e, "/secrets/key", testCase.authorization)
+
+			assert.Equal(t, http.StatusUnauthorized, response.Code)
+			assert.Equal(t, "Bearer", response.Header().Get("WWW-Authenticate"))
+			assert.JSONEq(t, `{"backend":"vault","detail":"`+testCase.detail+`","status":401,"title":"Unauthorized"}`, response.Body.String())
+		})
+	}
+	t.Run("records rejected operations in the audit log", func(t *testing.T) {
+		records := &[]string{}
+		e := echo.New()
+		e.Use(BearerAuth(staticTokens{"token": "node"}, true, recordingAuditor{records: records}))
+		handler := func(c echo.Context) error {
+			return c.NoContent(http.StatusNoContent)
+		}
+		e.GET("/secrets", handler)
+		e.GET("/secrets/:key", handler)
+		e.POST("/secrets/:key", handler)
+		e.DELETE("/secrets/:key", handler)
+		e.GET("/health", handler)
+
+		for _, r := range []*http.Request{
+			httptest.NewRequest(http.MethodGet, "/secrets/key%231", nil),
+			httptest.NewRequest(http.MethodPost, "/secrets/key", nil),
+			httptest.NewRequest(http.MethodDelete, "/secrets/key", nil),
+			httptest.NewRequest(http.MethodGet, "/secrets", nil),
+			httptest.NewRequest(http.MethodGet, "/health", nil),
+		} {
+			r.Header.Set("Authorization", "Bearer other")
+			recorder := httptest.NewRecorder()
+			e.ServeHTTP(recorder, r)
+			assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+		}
+		assert.Equal(t, http.StatusNoContent, request(e, "/secrets/key", "Bearer token").Code)
+
+		assert.Equal(t, []string{"lookup key#1: unauthorized", "store key: unauthorized", "delete key: unauthorized", "list : unauthorized"}, *records)
+	})
+	t.Run("open health check", func(t *testing.T) {
+		e, _ := newServer(false)
+
+		assert.Equal(t, http.StatusNoContent, request(e, "/health", "").Code)
+	})
+	t.Run("protected health check", func(t *testing.T) {
+		e, _ := newServer(true)
+
+		assert.Equal(t, http.StatusUnauthorized, request(e, "/health", "").Code)
+		assert.Equal(t, http.StatusNoContent, request(e, "/health", "Bearer token").Code)
+	})
+}
@@ -0,0 +1,76 @@
+/*
+ * Copyright (C) 2023 Nuts community
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package v1
+
+import (
+	"math"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/nuts-foundation/hashicorp-vault-proxy/vault"
+)
+
+// healthStatus and tokenTTL are updated by every health check.
+var (
+	healthStatus = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "vault_proxy",
+		Name:      "health_status",
+		Help:      "Outcome of the last health check, 1 for the current status (pass, warn or fail).",
+	}, []string{"status"})
+	tokenTTL = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "vault_proxy",
+		Name:      "token_ttl_seconds",
+		Help:      "Remaining time-to-live of the Vault token as of the last health check, +Inf if the token does not expire.",
+	})
+)
+
+// RegisterMetrics registers the metrics of the health check.
+func RegisterMetrics(registerer prometheus.Registerer) error {
+	for _, collector := range []prometheus.Collector{healthStatus, tokenTTL} {
+		if err := registerer.Register(collector); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordHealth updates the health check metrics with the outcome of a health check.
+func recordHealth(response HealthCheckResponseObject, status *vault.Status) {
+	var current ServiceStatusStatus
+	switch r := response.(type) {
+	case HealthCheck200JSONResponse:
+		current = r.Status
+	case HealthCheck503JSONResponse:
+		current = r.Status
+	}
+	for _, s := range []ServiceStatusStatus{Pass, Warn, Fail} {
+		value := 0.0
+		if s == current {
+			value = 1
+		}
+		healthStatus.WithLabelValues(string(s)).Set(value)
+	}
+	if status == nil {
+		return
+	}
+	if status.TokenTTL > 0 {
+		tokenTTL.Set(status.TokenTTL.Seconds())
+	} else {
+		tokenTTL.Set(math.Inf(1))
+	}
+}
@@ -0,0 +1,61 @@
+/*
+ * Copyright (C) 2023 Nuts community
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package v1
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nuts-foundation/hashicorp-vault-proxy/vault"
+)
+
+func TestWrapper_HealthCheck_metrics(t *testing.T) {
+	healthCheck := func(t *testing.T, storage mockStorage) {
+		_, err := NewWrapper(storage, DefaultConfig()).HealthCheck(context.Background(), HealthCheckRequestObject{})
+		require.NoError(t, err)
+	}
+
+	t.Run("pass", func(t *testing.T) {
+		healthCheck(t, mockStorage{status: vault.Status{TokenTTL: time.Hour, TokenRenewable: true}})
+
+		assert.Equal(t, 1.0, testutil.ToFloat64(healthStatus.WithLabelValues("pass")))
+		assert.Equal(t, 0.0, testutil.ToFloat64(healthStatus.WithLabelValues("warn")))
+		assert.Equal(t, 0.0, testutil.ToFloat64(healthStatus.WithLabelValues("fail")))
+		assert.Equal(t, 3600.0, testutil.ToFloat64(tokenTTL))
+	})
+	t.Run("token does not expire", func(t *testing.T) {
+		healthCheck(t, mockStorage{})
+
+		assert.True(t, math.IsInf(testutil.ToFloat64(tokenTTL), 1))
+	})
+	t.Run("fail", func(t *testing.T) {
+		healthCheck(t, mockStorage{status: vault.Status{TokenTTL: time.Hour, TokenRenewable: true}})
+		healthCheck(t, mockStorage{err: errors.New("vault is down")})
+
+		assert.Equal(t, 0.0, testutil.ToFloat64(healthStatus.WithLabelValues("pass")))
+		assert.Equal(t, 1.0, testutil.ToFloat64(healthStatus.WithLabelValues("fail")))
+		assert.Equal(t, 3600.0, testutil.ToFloat64(tokenTTL), "token TTL should not be updated when it is unknown")
+	})
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright (C) 2023 Nuts community
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package v1
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/nuts-foundation/hashicorp-vault-proxy/vault"
+)
+
+// errorResponse is an ErrorResponse with a status code for which the API specification doesn't define a response (e.g. 503).
+// It implements the response object interfaces of all secret operations.
+type errorResponse struct {
+	ErrorResponse
+	// retryAfter is the number of seconds after which the client may retry the request, if not zero.
+	retryAfter int
+}
+
+func (response errorResponse) visit(w http.ResponseWriter) error {
+	if response.retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(response.retryAfter))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(response.Status)
+	return json.NewEncoder(w).Encode(response.ErrorResponse)
+}
+
+func (response errorResponse) VisitListKeysResponse(w http.ResponseWriter) error {
+	return response.visit(w)
+}
+
+func (response errorResponse) VisitDeleteSecretResponse(w http.ResponseWriter) error {
+	return response.visit(w)
+}
+
+func (response errorResponse) VisitLookupSecretResponse(w http.ResponseWriter) error {
+	return response.visit(w)
+}
+
+func (response errorResponse) VisitStoreSecretResponse(w http.ResponseWriter) error {
+	return response.visit(w)
+}
+
+// staleWarning is the Warning header (RFC 7234) of responses containing a stale secret.
+const staleWarning = `110 - "Response is Stale"`
+
+// staleSecretResponse is a LookupSecret200JSONResponse of a stale secret, served because Vault is unavailable.
+// It is flagged with a Warning header.
+type staleSecretResponse struct {
+	SecretResponse
+}
+
+func (response staleSecretResponse) VisitLookupSecretResponse(w http.ResponseWriter) error {
+	w.Header().Set("Warning", staleWarning)
+	return LookupSecret200JSONResponse(response.SecretResponse).VisitLookupSecretResponse(w)
+}
+
+// retryAfterSeconds is the Retry-After of responses to requests rejected to protect Vault against overload.
+const retryAfterSeconds = 1
+
+// storageErrorResponse returns the response for storage errors that have a more specific status code than 500,
+// e.g. when Vault denied access or is unavailable. It returns false if there's no specific response for the error.
+func storageErrorResponse(err error) (errorResponse, bool) {
+	response := errorResponse{ErrorResponse: ErrorResponse{Backend: backend, Detail: err.Error()}}
+	switch {
+	case errors.Is(err, vault.ErrBusy):
+		response.Status = http.StatusTooManyRequests
+		response.Title = "Too many concurrent requests to Vault"
+		response.retryAfter = retryAfterSeconds
+	case errors.Is(err, vault.ErrPermissionDenied):
+		response.Status = http.StatusForbidden
+		response.Title = "Permission denied by Vault"
+	case errors.Is(err, vault.ErrInvalidPath):
+		response.Status = http.StatusBadRequest
+		response.Title = "Invalid secret path"
+	case errors.Is(err, vault.ErrRateLimited):
+		response.Status = http.StatusTooManyRequests
+		response.Title = "Rate limited by Vault"
+		response.retryAfter = retryAfterSeconds
+	case errors.Is(err, vault.ErrTimeout):
+		response.Status = http.StatusGatewayTimeout
+		response.Title = "Vault request timed out"
+	case errors.Is(err, vault.ErrSealed):
+		response.Status = http.StatusServiceUnavailable
+		response.Title = "Vault is sealed"
+	case errors.Is(err, vault.ErrUnavailable):
+		response.Status = http.StatusServiceUnavailable
+		response.Title = "Vault is unavailable"
+	default:
+		return errorResponse{}, false
+	}
+	return response, true
+}
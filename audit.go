@@ -0,0 +1,67 @@
+/*
+ * Copyright (C) 2023 Nuts community
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/nuts-foundation/hashicorp-vault-proxy/audit"
+)
+
+// verifyAuditLogCommand is the command verifying the audit log files given as arguments, instead of starting the proxy.
+const verifyAuditLogCommand = "verify-audit-log"
+
+// openAuditLog returns the audit logger writing to the given destination, which is either a file path or "stdout".
+func openAuditLog(destination string, hashKey []byte) (*audit.Logger, io.Closer, error) {
+	if destination == "stdout" {
+		logger, err := audit.NewLogger(os.Stdout, hashKey)
+		return logger, io.NopCloser(nil), err
+	}
+	return audit.Open(destination, hashKey)
+}
+
+// verifyAuditLog verifies the given audit log files, using the hash key of AUDIT_LOG_KEY, and returns the exit code of the command.
+func verifyAuditLog(paths []string) int {
+	if len(paths) == 0 {
+		_, _ = fmt.Fprintf(os.Stderr, "usage: AUDIT_LOG_KEY=<key> %s %s <audit log file>...\n", os.Args[0], verifyAuditLogCommand)
+		return 2
+	}
+	_, hashKey := loadAuditLog()
+	exitCode := 0
+	for _, path := range paths {
+		count, err := verifyAuditLogFile(path, hashKey)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%s: NOT OK after %d entries: %s\n", path, count, err)
+			exitCode = 1
+			continue
+		}
+		fmt.Printf("%s: OK, %d entries\n", path, count)
+	}
+	return exitCode
+}
+
+func verifyAuditLogFile(path string, hashKey []byte) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	return audit.Verify(file, hashKey)
+}
@@ -0,0 +1,238 @@
+/*
+ * Copyright (C) 2023 Nuts community
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package audit writes a tamper-evident log of the access to secrets.
+// Every entry contains the hash of the previous entry, so removed or altered entries are detected by Verify.
+// The hashes are keyed (HMAC-SHA256), so they can't be recomputed without the key of the audit log.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// The operations recorded in the audit log.
+const (
+	OperationLookup = "lookup"
+	OperationStore  = "store"
+	OperationDelete = "delete"
+	OperationList   = "list"
+	// OperationConnect is the TLS connection to the API, which is only recorded when it is rejected.
+	OperationConnect = "connect"
+)
+
+// The results of the operations recorded in the audit log.
+const (
+	ResultSuccess  = "success"
+	ResultStale    = "stale"
+	ResultNotFound = "not_found"
+	ResultConflict = "conflict"
+	ResultInvalid  = "invalid"
+	ResultError    = "error"
+	// ResultUnauthorized is the result of operations rejected because the client didn't authenticate.
+	ResultUnauthorized = "unauthorized"
+)
+
+// maxEntrySize is the maximum size of an entry read from the audit log.
+const maxEntrySize = 64 * 1024
+
+// Entry is a line of the audit log.
+type Entry struct {
+	Time      time.Time `json:"time"`
+	Operation string    `json:"operation"`
+	// Key is the keyed hash of the key ID, so the log doesn't reveal the keys but can be searched for a known key using HashKey.
+	Key      string `json:"key,omitempty"`
+	Client   string `json:"client,omitempty"`
+	RemoteIP string `json:"remote_ip,omitempty"`
+	Result   string `json:"result"`
+	// Previous is the hash of the previous entry, empty for the first entry of the log.
+	Previous string `json:"prev"`
+	// Hash is the hash of the entry, including the hash of the previous entry.
+	Hash string `json:"hash,omitempty"`
+}
+
+// errNoHashKey is returned when the key of the audit log hashes is missing.
+var errNoHashKey = errors.New("a hash key is required for the audit log")
+
+// hash returns the hash of the entry, which is the keyed hash of its JSON encoding without the hash.
+func (e Entry) hash(hashKey []byte) (string, error) {
+	e.Hash = ""
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	return keyedHash(hashKey, data), nil
+}
+
+// HashKey returns the hash of a key ID as recorded in the audit log with the given hash key.
+func HashKey(hashKey []byte, key string) string {
+	return keyedHash(hashKey, []byte(key))
+}
+
+func keyedHash(hashKey []byte, data []byte) string {
+	mac := hmac.New(sha256.New, hashKey)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Logger writes the entries of the audit log as JSON lines.
+type Logger struct {
+	now     func() time.Time
+	hashKey []byte
+
+	mux      sync.Mutex
+	writer   io.Writer
+	previous string
+}
+
+// NewLogger returns a Logger writing a new audit log to the given writer, hashing the entries and key IDs with the given key.
+func NewLogger(writer io.Writer, hashKey []byte) (*Logger, error) {
+	if len(hashKey) == 0 {
+		return nil, errNoHashKey
+	}
+	return &Logger{writer: writer, hashKey: hashKey, now: time.Now}, nil
+}
+
+// Open returns a Logger appending to the audit log file at the given path, which is created if it doesn't exist.
+// The new entries continue the chain of the entries already in the file.
+func Open(path string, hashKey []byte) (*Logger, *os.File, error) {
+	if len(hashKey) == 0 {
+		return nil, nil, errNoHashKey
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to open audit log: %w", err)
+	}
+	last, err := lastEntry(file)
+	if err != nil {
+		_ = file.Close()
+		return nil, nil, fmt.Errorf("unable to read audit log %s: %w", path, err)
+	}
+	logger := &Logger{writer: file, hashKey: hashKey, now: time.Now}
+	if last != nil {
+		logger.previous = last.Hash
+	}
+	return logger, file, nil
+}
+
+// lastEntry returns the last entry of the audit log, or nil if it is empty.
+func lastEntry(reader io.Reader) (*Entry, error) {
+	var last []byte
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 4096), maxEntrySize)
+	for scanner.Scan() {
+		if line := bytes.TrimSpace(scanner.Bytes()); len(line) > 0 {
+			last = append(last[:0], line...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if last == nil {
+		return nil, nil
+	}
+	var entry Entry
+	if err := json.Unmarshal(last, &entry); err != nil {
+		return nil, fmt.Errorf("invalid last entry: %w", err)
+	}
+	return &entry, nil
+}
+
+// Record writes an entry for the operation on the given key (empty for operations on all keys) by the client in the context.
+func (l *Logger) Record(ctx context.Context, operation string, key string, result string) error {
+	client := ClientFromContext(ctx)
+	entry := Entry{
+		Time:      l.now().UTC(),
+		Operation: operation,
+		Client:    client.ID,
+		RemoteIP:  client.RemoteIP,
+		Result:    result,
+	}
+	if key != "" {
+		entry.Key = HashKey(l.hashKey, key)
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	entry.Previous = l.previous
+	var err error
+	if entry.Hash, err = entry.hash(l.hashKey); err != nil {
+		return err
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err = l.writer.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("unable to write audit log: %w", err)
+	}
+	// the chain only continues from entries that were written
+	l.previous = entry.Hash
+	return nil
+}
+
+// Verify checks the chain of the entries in the audit log, written with the given hash key, and returns the number of entries.
+// It returns an error describing the first entry that was altered, or doesn't follow the previous entry.
+func Verify(reader io.Reader, hashKey []byte) (int, error) {
+	if len(hashKey) == 0 {
+		return 0, errNoHashKey
+	}
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 4096), maxEntrySize)
+	previous := ""
+	count := 0
+	for line := 1; scanner.Scan(); line++ {
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		var entry Entry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return count, fmt.Errorf("line %d: invalid entry: %w", line, err)
+		}
+		if entry.Previous != previous {
+			return count, fmt.Errorf("line %d: entry doesn't follow the previous entry, entries were removed or inserted", line)
+		}
+		hash, err := entry.hash(hashKey)
+		if err != nil {
+			return count, fmt.Errorf("line %d: %w", line, err)
+		}
+		if hash != entry.Hash {
+			return count, fmt.Errorf("line %d: entry was altered", line)
+		}
+		previous = entry.Hash
+		count++
+	}
+	if err := scanner.Err(); err != nil {
+		return count, err
+	}
+	if count == 0 {
+		return 0, errors.New("audit log is empty")
+	}
+	return count, nil
+}
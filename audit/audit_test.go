@@ -0,0 +1,224 @@
+/*
+ * Copyright (C) 2023 Nuts community
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package audit
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const key = "did:nuts:123#key-1"
+
+var hashKey = []byte("audit log key")
+
+// writeLog returns an audit log with the given number of entries.
+func writeLog(t *testing.T, count int) []string {
+	buf := &bytes.Buffer{}
+	logger, err := NewLogger(buf, hashKey)
+	require.NoError(t, err)
+	ctx := WithClient(context.Background(), Client{ID: "node", RemoteIP: "10.0.0.1"})
+	for i := 0; i < count; i++ {
+		require.NoError(t, logger.Record(ctx, OperationLookup, key, ResultSuccess))
+	}
+	return strings.SplitAfter(strings.TrimSuffix(buf.String(), "\n"), "\n")
+}
+
+func TestLogger_Record(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger, err := NewLogger(buf, hashKey)
+	require.NoError(t, err)
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	logger.now = func() time.Time { return now }
+	ctx := WithClient(context.Background(), Client{ID: "node", RemoteIP: "10.0.0.1"})
+
+	require.NoError(t, logger.Record(ctx, OperationStore, key, ResultSuccess))
+	require.NoError(t, logger.Record(context.Background(), OperationList, "", ResultError))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+	assert.NotContains(t, buf.String(), key)
+	var first, second Entry
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &first))
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &second))
+	assert.Equal(t, Entry{
+		Time:      now,
+		Operation: OperationStore,
+		Key:       HashKey(hashKey, key),
+		Client:    "node",
+		RemoteIP:  "10.0.0.1",
+		Result:    ResultSuccess,
+		Hash:      first.Hash,
+	}, first)
+	assert.Len(t, first.Hash, 64)
+	assert.Equal(t, first.Hash, second.Previous)
+	assert.Empty(t, second.Key)
+	assert.Empty(t, second.Client)
+	assert.NotEqual(t, HashKey([]byte("other key"), key), first.Key, "key IDs must not be hashed without the hash key")
+
+	t.Run("no hash key", func(t *testing.T) {
+		_, err := NewLogger(buf, nil)
+
+		assert.EqualError(t, err, "a hash key is required for the audit log")
+	})
+}
+
+func TestVerify(t *testing.T) {
+	t.Run("ok", func(t *testing.T) {
+		count, err := Verify(strings.NewReader(strings.Join(writeLog(t, 3), "")), hashKey)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 3, count)
+	})
+	t.Run("altered entry", func(t *testing.T) {
+		lines := writeLog(t, 3)
+		lines[1] = strings.Replace(lines[1], ResultSuccess, ResultNotFound, 1)
+
+		count, err := Verify(strings.NewReader(strings.Join(lines, "")), hashKey)
+
+		assert.EqualError(t, err, "line 2: entry was altered")
+		assert.Equal(t, 1, count)
+	})
+	t.Run("removed entry", func(t *testing.T) {
+		lines := writeLog(t, 3)
+
+		_, err := Verify(strings.NewReader(lines[0]+lines[2]), hashKey)
+
+		assert.EqualError(t, err, "line 2: entry doesn't follow the previous entry, entries were removed or inserted")
+	})
+	t.Run("removed first entry", func(t *testing.T) {
+		lines := writeLog(t, 3)
+
+		_, err := Verify(strings.NewReader(lines[1]+lines[2]), hashKey)
+
+		assert.EqualError(t, err, "line 1: entry doesn't follow the previous entry, entries were removed or inserted")
+	})
+	t.Run("recomputed hashes", func(t *testing.T) {
+		lines := writeLog(t, 1)
+		var entry Entry
+		require.NoError(t, json.Unmarshal([]byte(lines[0]), &entry))
+		entry.Result = ResultNotFound
+		entry.Hash = ""
+		data, err := json.Marshal(entry)
+		require.NoError(t, err)
+		sum := sha256.Sum256(data)
+		entry.Hash = hex.EncodeToString(sum[:])
+		data, err = json.Marshal(entry)
+		require.NoError(t, err)
+
+		_, err = Verify(bytes.NewReader(data), hashKey)
+
+		assert.EqualError(t, err, "line 1: entry was altered")
+	})
+	t.Run("other hash key", func(t *testing.T) {
+		_, err := Verify(strings.NewReader(strings.Join(writeLog(t, 1), "")), []byte("other key"))
+
+		assert.EqualError(t, err, "line 1: entry was altered")
+	})
+	t.Run("no hash key", func(t *testing.T) {
+		_, err := Verify(strings.NewReader(strings.Join(writeLog(t, 1), "")), nil)
+
+		assert.EqualError(t, err, "a hash key is required for the audit log")
+	})
+	t.Run("invalid entry", func(t *testing.T) {
+		_, err := Verify(strings.NewReader("not json\n"), hashKey)
+
+		assert.ErrorContains(t, err, "line 1: invalid entry")
+	})
+	t.Run("empty", func(t *testing.T) {
+		_, err := Verify(strings.NewReader(""), hashKey)
+
+		assert.EqualError(t, err, "audit log is empty")
+	})
+}
+
+func TestOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	for i := 0; i < 2; i++ {
+		logger, file, err := Open(path, hashKey)
+		require.NoError(t, err)
+		require.NoError(t, logger.Record(context.Background(), OperationDelete, key, ResultSuccess))
+		require.NoError(t, file.Close())
+	}
+
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+	count, err := Verify(file, hashKey)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count, "entries written after reopening should continue the chain")
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
+
+func TestMiddleware(t *testing.T) {
+	e := echo.New()
+	e.Use(Middleware())
+	var client Client
+	e.GET("/", func(c echo.Context) error {
+		client = ClientFromContext(c.Request().Context())
+		return c.NoContent(http.StatusOK)
+	})
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.RemoteAddr = "10.0.0.1:1234"
+
+	e.ServeHTTP(httptest.NewRecorder(), request)
+
+	assert.Equal(t, Client{RemoteIP: "10.0.0.1"}, client)
+
+	t.Run("ignores forwarded headers", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		request.RemoteAddr = "10.0.0.1:1234"
+		request.Header.Set(echo.HeaderXForwardedFor, "192.168.1.1")
+		request.Header.Set(echo.HeaderXRealIP, "192.168.1.1")
+
+		e.ServeHTTP(httptest.NewRecorder(), request)
+
+		assert.Equal(t, Client{RemoteIP: "10.0.0.1"}, client)
+	})
+	t.Run("client certificate", func(t *testing.T) {
+		certificates := map[string]*x509.Certificate{
+			"node":             {Subject: pkix.Name{CommonName: "node"}, DNSNames: []string{"node.example.com"}},
+			"node.example.com": {DNSNames: []string{"node.example.com"}},
+		}
+		for expected, certificate := range certificates {
+			request.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{certificate}}
+
+			e.ServeHTTP(httptest.NewRecorder(), request)
+
+			assert.Equal(t, Client{ID: expected, RemoteIP: "10.0.0.1"}, client)
+		}
+	})
+}
@@ -0,0 +1,71 @@
+/*
+ * Copyright (C) 2023 Nuts community
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package audit
+
+import (
+	"context"
+	"crypto/x509"
+
+	"github.com/labstack/echo/v4"
+)
+
+type clientKey struct{}
+
+// Client identifies the client performing an operation.
+type Client struct {
+	// ID is the identity of the authenticated client, empty if the client isn't authenticated.
+	ID string
+	// RemoteIP is the IP address the request originates from.
+	RemoteIP string
+}
+
+// WithClient returns a context recording the operations as performed by the given client.
+func WithClient(ctx context.Context, client Client) context.Context {
+	return context.WithValue(ctx, clientKey{}, client)
+}
+
+// ClientFromContext returns the client set by WithClient, or an empty Client.
+func ClientFromContext(ctx context.Context) Client {
+	client, _ := ctx.Value(clientKey{}).(Client)
+	return client
+}
+
+// CertificateName returns the name of the client presenting the certificate, which is its common name (or first DNS name).
+func CertificateName(certificate *x509.Certificate) string {
+	if certificate.Subject.CommonName == "" && len(certificate.DNSNames) > 0 {
+		return certificate.DNSNames[0]
+	}
+	return certificate.Subject.CommonName
+}
+
+// Middleware returns the echo middleware recording the client of the request in its context:
+// its remote IP (ignoring the X-Forwarded-For and X-Real-IP headers, which can be set by the client) and, if it presented a TLS client certificate, the common name (or first DNS name) of the certificate.
+func Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			request := c.Request()
+			client := Client{RemoteIP: echo.ExtractIPDirect()(request)}
+			if request.TLS != nil && len(request.TLS.PeerCertificates) > 0 {
+				client.ID = CertificateName(request.TLS.PeerCertificates[0])
+			}
+			ctx := WithClient(request.Context(), client)
+			c.SetRequest(request.WithContext(ctx))
+			return next(c)
+		}
+	}
+}
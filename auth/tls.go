@@ -0,0 +1,197 @@
+/*
+ * Copyright (C) 2023 Nuts community
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/nuts-foundation/hashicorp-vault-proxy/audit"
+	"github.com/nuts-foundation/hashicorp-vault-proxy/internal/files"
+)
+
+// spkiPinPrefix is the optional prefix of SPKI pins, as used by e.g. HPKP and curl's --pinnedpubkey.
+const spkiPinPrefix = "sha256//"
+
+// TLSConfig contains the settings for serving the API over TLS, requiring client certificates.
+type TLSConfig struct {
+	// CertFile is the path of the PEM encoded server certificate (chain).
+	CertFile string
+	// KeyFile is the path of the PEM encoded private key of the server certificate.
+	KeyFile string
+	// CAFile is the path of the PEM encoded CA certificates the client certificates must be issued by.
+	CAFile string
+	// AllowedSubjects are the accepted common names or DNS names of client certificates.
+	AllowedSubjects []string
+	// AllowedSPKIPins are the accepted base64 encoded SHA-256 hashes of the public keys (SubjectPublicKeyInfo) of client certificates.
+	AllowedSPKIPins []string
+}
+
+// Enabled returns whether the API is served over TLS, which is the case if any of the settings is set.
+// Partial settings are rejected by NewServerTLS, instead of silently serving plain HTTP.
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != "" || c.KeyFile != "" || c.CAFile != "" || len(c.AllowedSubjects) > 0 || len(c.AllowedSPKIPins) > 0
+}
+
+func (c TLSConfig) validate() error {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return errors.New("TLS requires a certificate and key file")
+	}
+	if c.CAFile == "" {
+		return errors.New("TLS requires a CA file to verify client certificates")
+	}
+	for _, pin := range c.AllowedSPKIPins {
+		hash, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, spkiPinPrefix))
+		if err != nil || len(hash) != sha256.Size {
+			return fmt.Errorf("invalid SPKI pin: %s", pin)
+		}
+	}
+	return nil
+}
+
+// ServerTLS provides the TLS configuration of the API server, which requires client certificates issued by the configured CAs
+// and accepted by the allowlist. The certificate, key and CA files are loaded again when they change.
+type ServerTLS struct {
+	config  TLSConfig
+	pins    [][]byte
+	files   *files.Reloader[serverFiles]
+	auditor Auditor
+}
+
+// Auditor records the connections rejected by the allowlist in the audit log.
+type Auditor interface {
+	Record(ctx context.Context, operation string, key string, result string) error
+}
+
+// serverFiles contains the contents of the certificate, key and CA files.
+type serverFiles struct {
+	certificate *tls.Certificate
+	clientCAs   *x509.CertPool
+}
+
+// NewServerTLS loads the certificate, key and CA files of the given config.
+// Connections rejected by the allowlist are recorded in the audit log of the auditor, if set.
+func NewServerTLS(config TLSConfig, auditor Auditor) (*ServerTLS, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	s := &ServerTLS{config: config, auditor: auditor}
+	for _, pin := range config.AllowedSPKIPins {
+		hash, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, spkiPinPrefix))
+		s.pins = append(s.pins, hash)
+	}
+	var err error
+	if s.files, err = files.NewReloader("TLS certificate and CA file", s.load, config.CertFile, config.KeyFile, config.CAFile); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *ServerTLS) load() (serverFiles, error) {
+	certificate, err := tls.LoadX509KeyPair(s.config.CertFile, s.config.KeyFile)
+	if err != nil {
+		return serverFiles{}, fmt.Errorf("unable to load TLS certificate: %w", err)
+	}
+	data, err := os.ReadFile(s.config.CAFile)
+	if err != nil {
+		return serverFiles{}, fmt.Errorf("unable to read TLS CA file: %w", err)
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(data) {
+		return serverFiles{}, fmt.Errorf("no certificates found in TLS CA file %s", s.config.CAFile)
+	}
+	return serverFiles{certificate: &certificate, clientCAs: clientCAs}, nil
+}
+
+// TLSConfig returns the configuration of the TLS listener of the API server.
+func (s *ServerTLS) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			current := s.files.Get()
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*current.certificate},
+				ClientAuth:   tls.RequireAndVerifyClientCert,
+				ClientCAs:    current.clientCAs,
+				VerifyConnection: func(state tls.ConnectionState) error {
+					return s.verifyConnection(hello.Conn.RemoteAddr(), state)
+				},
+			}, nil
+		},
+	}
+}
+
+// verifyConnection rejects client certificates that aren't on the allowlist, after they have been verified against the CAs.
+func (s *ServerTLS) verifyConnection(remoteAddr net.Addr, state tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("client certificate required")
+	}
+	if !s.allowed(state.PeerCertificates[0]) {
+		logrus.WithField("subject", state.PeerCertificates[0].Subject.String()).Warn("Rejected client certificate that is not on the allowlist")
+		s.auditRejected(remoteAddr, state.PeerCertificates[0])
+		return errors.New("client certificate is not allowed")
+	}
+	return nil
+}
+
+// auditRejected records the connection rejected by the allowlist in the audit log.
+func (s *ServerTLS) auditRejected(remoteAddr net.Addr, certificate *x509.Certificate) {
+	if s.auditor == nil {
+		return
+	}
+	client := audit.Client{ID: audit.CertificateName(certificate)}
+	if remoteAddr != nil {
+		client.RemoteIP, _, _ = net.SplitHostPort(remoteAddr.String())
+	}
+	ctx := audit.WithClient(context.Background(), client)
+	if err := s.auditor.Record(ctx, audit.OperationConnect, "", audit.ResultUnauthorized); err != nil {
+		logrus.WithError(err).Error("Unable to record rejected connection in the audit log")
+	}
+}
+
+// allowed returns whether the client certificate matches one of the allowed subjects or SPKI pins.
+// If neither is configured, all certificates issued by the CAs are allowed.
+func (s *ServerTLS) allowed(certificate *x509.Certificate) bool {
+	if len(s.config.AllowedSubjects) == 0 && len(s.pins) == 0 {
+		return true
+	}
+	for _, subject := range s.config.AllowedSubjects {
+		if certificate.Subject.CommonName == subject || slices.Contains(certificate.DNSNames, subject) {
+			return true
+		}
+	}
+	spki := sha256.Sum256(certificate.RawSubjectPublicKeyInfo)
+	for _, pin := range s.pins {
+		if string(pin) == string(spki[:]) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,265 @@
+/*
+ * Copyright (C) 2023 Nuts community
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nuts-foundation/hashicorp-vault-proxy/audit"
+)
+
+// testCertificate is a certificate with its private key, signed by a test CA (or itself).
+type testCertificate struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+}
+
+func newTestCertificate(t *testing.T, name string, issuer *testCertificate) testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name + ".example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	parent, signer := template, key
+	if issuer == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		parent, signer = issuer.certificate, issuer.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	require.NoError(t, err)
+	certificate, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return testCertificate{certificate: certificate, key: key}
+}
+
+func (c testCertificate) certPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.certificate.Raw})
+}
+
+func (c testCertificate) write(t *testing.T, certFile, keyFile string) {
+	der, err := x509.MarshalECPrivateKey(c.key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(certFile, c.certPEM(), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600))
+}
+
+func (c testCertificate) tls() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.certificate.Raw}, PrivateKey: c.key, Leaf: c.certificate}
+}
+
+func (c testCertificate) spkiPin() string {
+	sum := sha256.Sum256(c.certificate.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// recordingAuditor is an Auditor which keeps the recorded operations.
+type recordingAuditor struct {
+	mutex   sync.Mutex
+	records []string
+}
+
+func (a *recordingAuditor) Record(ctx context.Context, operation string, key string, result string) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	client := audit.ClientFromContext(ctx)
+	a.records = append(a.records, fmt.Sprintf("%s %s (%s, %s): %s", operation, key, client.ID, client.RemoteIP, result))
+	return nil
+}
+
+func TestServerTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCertificate(t, "ca", nil)
+	config := TLSConfig{
+		CertFile: filepath.Join(dir, "server.pem"),
+		KeyFile:  filepath.Join(dir, "server.key"),
+		CAFile:   filepath.Join(dir, "ca.pem"),
+	}
+	newTestCertificate(t, "server", &ca).write(t, config.CertFile, config.KeyFile)
+	require.NoError(t, os.WriteFile(config.CAFile, ca.certPEM(), 0600))
+	allowed := newTestCertificate(t, "node-1", &ca)
+	pinned := newTestCertificate(t, "node-2", &ca)
+	other := newTestCertificate(t, "node-3", &ca)
+	config.AllowedSubjects = []string{"node-1"}
+	config.AllowedSPKIPins = []string{spkiPinPrefix + pinned.spkiPin()}
+
+	auditor := &recordingAuditor{}
+	serverTLS, err := NewServerTLS(config, auditor)
+	require.NoError(t, err)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	server.TLS = serverTLS.TLSConfig()
+	server.StartTLS()
+	defer server.Close()
+	// get performs a request presenting the given client certificate, if any, and returns the server certificate.
+	get := func(client *testCertificate) (*x509.Certificate, error) {
+		roots := x509.NewCertPool()
+		roots.AddCert(ca.certificate)
+		clientConfig := &tls.Config{RootCAs: roots, ServerName: "server.example.com"}
+		if client != nil {
+			clientConfig.Certificates = []tls.Certificate{client.tls()}
+		}
+		httpClient := http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+		response, err := httpClient.Get(server.URL)
+		if err != nil {
+			return nil, err
+		}
+		defer response.Body.Close()
+		return response.TLS.PeerCertificates[0], nil
+	}
+
+	t.Run("allowed subject", func(t *testing.T) {
+		_, err := get(&allowed)
+		assert.NoError(t, err)
+	})
+	t.Run("allowed SPKI pin", func(t *testing.T) {
+		_, err := get(&pinned)
+		assert.NoError(t, err)
+	})
+	t.Run("not on the allowlist", func(t *testing.T) {
+		_, err := get(&other)
+		assert.Error(t, err)
+		auditor.mutex.Lock()
+		defer auditor.mutex.Unlock()
+		assert.Equal(t, []string{"connect  (node-3, 127.0.0.1): unauthorized"}, auditor.records)
+	})
+	t.Run("no client certificate", func(t *testing.T) {
+		_, err := get(nil)
+		assert.Error(t, err)
+	})
+	t.Run("issued by another CA", func(t *testing.T) {
+		otherCA := newTestCertificate(t, "other-ca", nil)
+		client := newTestCertificate(t, "node-1", &otherCA)
+		_, err := get(&client)
+		assert.Error(t, err)
+	})
+	t.Run("reloads changed files", func(t *testing.T) {
+		renewed := newTestCertificate(t, "server", &ca)
+		renewed.write(t, config.CertFile, config.KeyFile)
+		future := time.Now().Add(time.Minute)
+		require.NoError(t, os.Chtimes(config.CertFile, future, future))
+		require.NoError(t, os.Chtimes(config.KeyFile, future, future))
+
+		certificate, err := get(&allowed)
+
+		require.NoError(t, err)
+		assert.Equal(t, renewed.certificate.SerialNumber, certificate.SerialNumber)
+	})
+	t.Run("keeps certificate if the changed files are invalid", func(t *testing.T) {
+		current, err := get(&allowed)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(config.CAFile, []byte("invalid"), 0600))
+
+		certificate, err := get(&allowed)
+
+		require.NoError(t, err)
+		assert.Equal(t, current.SerialNumber, certificate.SerialNumber)
+	})
+}
+
+func TestServerTLS_allowed(t *testing.T) {
+	ca := newTestCertificate(t, "ca", nil)
+	client := newTestCertificate(t, "node-1", &ca)
+
+	testCases := map[string]struct {
+		config   TLSConfig
+		expected bool
+	}{
+		"no allowlist":   {TLSConfig{}, true},
+		"common name":    {TLSConfig{AllowedSubjects: []string{"node-1"}}, true},
+		"DNS name":       {TLSConfig{AllowedSubjects: []string{"node-1.example.com"}}, true},
+		"other subject":  {TLSConfig{AllowedSubjects: []string{"node-2"}}, false},
+		"SPKI pin":       {TLSConfig{AllowedSPKIPins: []string{client.spkiPin()}}, true},
+		"other SPKI pin": {TLSConfig{AllowedSPKIPins: []string{ca.spkiPin()}}, false},
+		"subject or pin": {TLSConfig{AllowedSubjects: []string{"node-2"}, AllowedSPKIPins: []string{client.spkiPin()}}, true},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			s := &ServerTLS{config: testCase.config}
+			for _, pin := range testCase.config.AllowedSPKIPins {
+				hash, _ := base64.StdEncoding.DecodeString(pin)
+				s.pins = append(s.pins, hash)
+			}
+			assert.Equal(t, testCase.expected, s.allowed(client.certificate))
+		})
+	}
+}
+
+func TestTLSConfig_Enabled(t *testing.T) {
+	assert.False(t, TLSConfig{}.Enabled())
+	assert.True(t, TLSConfig{CertFile: "cert.pem", KeyFile: "key.pem", CAFile: "ca.pem"}.Enabled())
+	t.Run("partial settings", func(t *testing.T) {
+		for _, config := range []TLSConfig{
+			{KeyFile: "key.pem"},
+			{CAFile: "ca.pem"},
+			{AllowedSubjects: []string{"node-1"}},
+			{AllowedSPKIPins: []string{"pin"}},
+		} {
+			assert.True(t, config.Enabled())
+			_, err := NewServerTLS(config, nil)
+			assert.Error(t, err)
+		}
+	})
+}
+
+func TestTLSConfig_validate(t *testing.T) {
+	valid := TLSConfig{CertFile: "cert.pem", KeyFile: "key.pem", CAFile: "ca.pem"}
+	assert.NoError(t, valid.validate())
+
+	invalid := valid
+	invalid.KeyFile = ""
+	assert.EqualError(t, invalid.validate(), "TLS requires a certificate and key file")
+	invalid = valid
+	invalid.CAFile = ""
+	assert.EqualError(t, invalid.validate(), "TLS requires a CA file to verify client certificates")
+	invalid = valid
+	invalid.AllowedSPKIPins = []string{"not a pin"}
+	assert.EqualError(t, invalid.validate(), "invalid SPKI pin: not a pin")
+}
@@ -0,0 +1,148 @@
+/*
+ * Copyright (C) 2023 Nuts community
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package auth authenticates the clients of the proxy API, using bearer tokens or TLS client certificates.
+// The token file and certificates are loaded again when they change.
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/nuts-foundation/hashicorp-vault-proxy/internal/files"
+)
+
+// hashAlgorithm is the algorithm of the token hashes in the token file.
+// Tokens are expected to be long random strings, so a fast hash is sufficient.
+const hashAlgorithm = "sha256"
+
+// saltSize is the size of the salt of generated token hashes, in bytes.
+const saltSize = 16
+
+// tokenHash is an accepted token, as stored in the token file.
+type tokenHash struct {
+	name string
+	salt []byte
+	hash []byte
+}
+
+func (t tokenHash) matches(token string) bool {
+	return subtle.ConstantTimeCompare(hashToken(t.salt, token), t.hash) == 1
+}
+
+func hashToken(salt []byte, token string) []byte {
+	sum := sha256.Sum256(append(append([]byte(nil), salt...), token...))
+	return sum[:]
+}
+
+// HashToken returns the line of the token file accepting the given token, identifying the client by the given name.
+func HashToken(name string, token string) (string, error) {
+	if name == "" || strings.ContainsAny(name, ": \t\n") {
+		return "", errors.New("token name must be non-empty and can't contain colons or whitespace")
+	}
+	if token == "" {
+		return "", errors.New("token can't be empty")
+	}
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s:%s:%s:%s", name, hashAlgorithm, hex.EncodeToString(salt), hex.EncodeToString(hashToken(salt, token))), nil
+}
+
+// parseTokens parses the token file, which contains a name:sha256:salt:hash line (as returned by HashToken) per accepted token.
+// Empty lines and lines starting with # are ignored.
+func parseTokens(data []byte) ([]tokenHash, error) {
+	var tokens []tokenHash
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		parts := strings.Split(text, ":")
+		if len(parts) != 4 || parts[0] == "" {
+			return nil, fmt.Errorf("line %d: expected name:%s:salt:hash", line, hashAlgorithm)
+		}
+		if parts[1] != hashAlgorithm {
+			return nil, fmt.Errorf("line %d: unsupported hash algorithm: %s", line, parts[1])
+		}
+		salt, err := hex.DecodeString(parts[2])
+		if err != nil || len(salt) == 0 {
+			return nil, fmt.Errorf("line %d: invalid salt", line)
+		}
+		hash, err := hex.DecodeString(parts[3])
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("line %d: invalid hash", line)
+		}
+		tokens = append(tokens, tokenHash{name: parts[0], salt: salt, hash: hash})
+	}
+	return tokens, scanner.Err()
+}
+
+// Tokens contains the accepted bearer tokens, loaded from a file which is loaded again when it changes.
+type Tokens struct {
+	tokens *files.Reloader[[]tokenHash]
+}
+
+// LoadTokens loads the accepted tokens from the given file.
+func LoadTokens(file string) (*Tokens, error) {
+	tokens, err := files.NewReloader("API token file", func() ([]tokenHash, error) {
+		return loadTokens(file)
+	}, file)
+	if err != nil {
+		return nil, err
+	}
+	return &Tokens{tokens: tokens}, nil
+}
+
+func loadTokens(file string) ([]tokenHash, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read token file: %w", err)
+	}
+	tokens, err := parseTokens(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token file %s: %w", file, err)
+	}
+	return tokens, nil
+}
+
+// Len returns the number of accepted tokens.
+func (t *Tokens) Len() int {
+	return len(t.tokens.Get())
+}
+
+// Verify returns the name of the given token if it is accepted.
+// All accepted tokens are compared in constant time, so the time taken doesn't reveal which (part of a) token matched.
+func (t *Tokens) Verify(token string) (string, bool) {
+	name := ""
+	for _, accepted := range t.tokens.Get() {
+		if accepted.matches(token) && name == "" {
+			name = accepted.name
+		}
+	}
+	return name, name != ""
+}
@@ -0,0 +1,122 @@
+/*
+ * Copyright (C) 2023 Nuts community
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTokens writes a token file accepting the given tokens by name.
+func writeTokens(t *testing.T, file string, tokens map[string]string) {
+	lines := []string{"# accepted tokens", ""}
+	for name, token := range tokens {
+		line, err := HashToken(name, token)
+		require.NoError(t, err)
+		lines = append(lines, line)
+	}
+	require.NoError(t, os.WriteFile(file, []byte(strings.Join(lines, "\n")), 0600))
+}
+
+func TestTokens_Verify(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "tokens")
+	writeTokens(t, file, map[string]string{"node-1": "token-1", "node-2": "token-2"})
+	tokens, err := LoadTokens(file)
+	require.NoError(t, err)
+
+	t.Run("accepted", func(t *testing.T) {
+		name, ok := tokens.Verify("token-2")
+		assert.True(t, ok)
+		assert.Equal(t, "node-2", name)
+	})
+	t.Run("rejected", func(t *testing.T) {
+		for _, token := range []string{"token-3", "token-", "", "token-1 "} {
+			name, ok := tokens.Verify(token)
+			assert.False(t, ok, token)
+			assert.Empty(t, name)
+		}
+	})
+	t.Run("reloads changed file", func(t *testing.T) {
+		writeTokens(t, file, map[string]string{"node-3": "token-3"})
+		require.NoError(t, os.Chtimes(file, time.Now(), time.Now().Add(time.Minute)))
+
+		_, ok := tokens.Verify("token-1")
+		assert.False(t, ok, "removed token should be rejected")
+		name, ok := tokens.Verify("token-3")
+		assert.True(t, ok)
+		assert.Equal(t, "node-3", name)
+	})
+	t.Run("keeps tokens if the changed file is invalid", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(file, []byte("invalid"), 0600))
+		require.NoError(t, os.Chtimes(file, time.Now(), time.Now().Add(2*time.Minute)))
+
+		_, ok := tokens.Verify("token-3")
+		assert.True(t, ok)
+
+		writeTokens(t, file, map[string]string{"node-4": "token-4"})
+		_, ok = tokens.Verify("token-4")
+		assert.True(t, ok, "reload should be retried")
+	})
+}
+
+func TestLoadTokens(t *testing.T) {
+	dir := t.TempDir()
+	valid, err := HashToken("node", "token")
+	require.NoError(t, err)
+	testCases := map[string]string{
+		"node:sha256:00":                       "line 1: expected name:sha256:salt:hash",
+		"node:md5:00:00":                       "line 1: unsupported hash algorithm: md5",
+		"node:sha256:zz:00":                    "line 1: invalid salt",
+		"node:sha256:00:00":                    "line 1: invalid hash",
+		":" + strings.SplitN(valid, ":", 2)[1]: "line 1: expected name:sha256:salt:hash",
+		valid + "\n" + valid[:len(valid)-2]:    "line 2: invalid hash",
+	}
+	for contents, expected := range testCases {
+		file := filepath.Join(dir, "tokens")
+		require.NoError(t, os.WriteFile(file, []byte(contents), 0600))
+
+		_, err := LoadTokens(file)
+
+		assert.EqualError(t, err, "invalid token file "+file+": "+expected)
+	}
+	t.Run("missing file", func(t *testing.T) {
+		_, err := LoadTokens(filepath.Join(dir, "missing"))
+
+		assert.ErrorContains(t, err, "unable to read token file")
+	})
+}
+
+func TestHashToken(t *testing.T) {
+	first, err := HashToken("node", "token")
+	require.NoError(t, err)
+	second, err := HashToken("node", "token")
+	require.NoError(t, err)
+
+	assert.Regexp(t, `^node:sha256:[0-9a-f]{32}:[0-9a-f]{64}$`, first)
+	assert.NotEqual(t, first, second, "hashes should be salted")
+	_, err = HashToken("no:de", "token")
+	assert.EqualError(t, err, "token name must be non-empty and can't contain colons or whitespace")
+	_, err = HashToken("node", "")
+	assert.EqualError(t, err, "token can't be empty")
+}
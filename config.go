@@ -0,0 +1,272 @@
+/*
+ * Copyright (C) 2023 Nuts community
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	v1 "github.com/nuts-foundation/hashicorp-vault-proxy/api/v1"
+	"github.com/nuts-foundation/hashicorp-vault-proxy/auth"
+	"github.com/nuts-foundation/hashicorp-vault-proxy/redact"
+	"github.com/nuts-foundation/hashicorp-vault-proxy/vault"
+)
+
+// loadVaultConfig reads the configuration of the Vault storage backend from the environment.
+func loadVaultConfig() (vault.Config, error) {
+	var config vault.Config
+
+	// pathPrefix should always be set
+	config.MountPath = os.Getenv("VAULT_PATHPREFIX")
+	if config.MountPath == "" {
+		config.MountPath = "kv"
+	}
+
+	// pathName is optional
+	pathName, isSet := os.LookupEnv("VAULT_PATHNAME")
+	if !isSet {
+		pathName = "nuts-private-keys"
+	}
+	config.PathName = pathName
+
+	// kvVersion is detected from the mount when not set
+	if value := os.Getenv("VAULT_KV_VERSION"); value != "" && value != "auto" {
+		kvVersion, err := strconv.Atoi(value)
+		if err != nil {
+			return config, fmt.Errorf("invalid VAULT_KV_VERSION: %w", err)
+		}
+		config.KVVersion = kvVersion
+	}
+
+	if value := os.Getenv("VAULT_REQUEST_TIMEOUT"); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			return config, fmt.Errorf("invalid VAULT_REQUEST_TIMEOUT: %w", err)
+		}
+		config.RequestTimeout = timeout
+	}
+
+	config.Retry = vault.DefaultRetryConfig()
+	if value := os.Getenv("VAULT_RETRY_MAX_ATTEMPTS"); value != "" {
+		attempts, err := strconv.Atoi(value)
+		if err != nil {
+			return config, fmt.Errorf("invalid VAULT_RETRY_MAX_ATTEMPTS: %w", err)
+		}
+		config.Retry.MaxAttempts = attempts
+	}
+	if value := os.Getenv("VAULT_RETRY_INITIAL_BACKOFF"); value != "" {
+		backoff, err := time.ParseDuration(value)
+		if err != nil {
+			return config, fmt.Errorf("invalid VAULT_RETRY_INITIAL_BACKOFF: %w", err)
+		}
+		config.Retry.InitialBackoff = backoff
+	}
+	if value := os.Getenv("VAULT_RETRY_MAX_BACKOFF"); value != "" {
+		backoff, err := time.ParseDuration(value)
+		if err != nil {
+			return config, fmt.Errorf("invalid VAULT_RETRY_MAX_BACKOFF: %w", err)
+		}
+		config.Retry.MaxBackoff = backoff
+	}
+	if value := os.Getenv("VAULT_RETRY_JITTER"); value != "" {
+		jitter, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return config, fmt.Errorf("invalid VAULT_RETRY_JITTER: %w", err)
+		}
+		config.Retry.Jitter = jitter
+	}
+
+	config.Breaker = vault.DefaultBreakerConfig()
+	if value := os.Getenv("VAULT_CIRCUIT_BREAKER_THRESHOLD"); value != "" {
+		threshold, err := strconv.Atoi(value)
+		if err != nil {
+			return config, fmt.Errorf("invalid VAULT_CIRCUIT_BREAKER_THRESHOLD: %w", err)
+		}
+		config.Breaker.FailureThreshold = threshold
+	}
+	if value := os.Getenv("VAULT_CIRCUIT_BREAKER_OPEN_TIMEOUT"); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			return config, fmt.Errorf("invalid VAULT_CIRCUIT_BREAKER_OPEN_TIMEOUT: %w", err)
+		}
+		config.Breaker.OpenTimeout = timeout
+	}
+
+	config.Limiter = vault.DefaultLimiterConfig()
+	if value := os.Getenv("VAULT_MAX_CONCURRENT_REQUESTS"); value != "" {
+		maxConcurrent, err := strconv.Atoi(value)
+		if err != nil {
+			return config, fmt.Errorf("invalid VAULT_MAX_CONCURRENT_REQUESTS: %w", err)
+		}
+		config.Limiter.MaxConcurrent = maxConcurrent
+	}
+	if value := os.Getenv("VAULT_MAX_QUEUED_REQUESTS"); value != "" {
+		maxQueued, err := strconv.Atoi(value)
+		if err != nil {
+			return config, fmt.Errorf("invalid VAULT_MAX_QUEUED_REQUESTS: %w", err)
+		}
+		config.Limiter.MaxQueued = maxQueued
+	}
+	if value := os.Getenv("VAULT_QUEUE_TIMEOUT"); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			return config, fmt.Errorf("invalid VAULT_QUEUE_TIMEOUT: %w", err)
+		}
+		config.Limiter.QueueTimeout = timeout
+	}
+
+	config.Auth = vault.AuthConfig{
+		Method:    os.Getenv("VAULT_AUTH_METHOD"),
+		MountPath: os.Getenv("VAULT_AUTH_MOUNTPATH"),
+		AppRole: vault.AppRoleConfig{
+			RoleID:       os.Getenv("VAULT_APPROLE_ROLEID"),
+			SecretID:     os.Getenv("VAULT_APPROLE_SECRETID"),
+			SecretIDFile: os.Getenv("VAULT_APPROLE_SECRETID_FILE"),
+		},
+		Kubernetes: vault.KubernetesConfig{
+			Role:      os.Getenv("VAULT_KUBERNETES_ROLE"),
+			TokenFile: os.Getenv("VAULT_KUBERNETES_TOKEN_FILE"),
+		},
+		JWT: vault.JWTConfig{
+			Role:      os.Getenv("VAULT_JWT_ROLE"),
+			TokenFile: os.Getenv("VAULT_JWT_TOKEN_FILE"),
+		},
+		Cert: vault.CertConfig{
+			Role:     os.Getenv("VAULT_CERT_ROLE"),
+			CertFile: os.Getenv("VAULT_CERT_CERT_FILE"),
+			KeyFile:  os.Getenv("VAULT_CERT_KEY_FILE"),
+		},
+	}
+	return config, nil
+}
+
+// loadAdminListenAddress reads the address of the admin server, which serves the metrics, from the environment.
+// It returns an empty string if the admin server is disabled.
+func loadAdminListenAddress() string {
+	return os.Getenv("ADMIN_LISTEN_ADDRESS")
+}
+
+// loadCacheConfig reads the configuration of the secret cache from the environment.
+func loadCacheConfig() (vault.CacheConfig, error) {
+	config := vault.DefaultCacheConfig()
+	if value := os.Getenv("CACHE_TTL"); value != "" {
+		ttl, err := time.ParseDuration(value)
+		if err != nil {
+			return config, fmt.Errorf("invalid CACHE_TTL: %w", err)
+		}
+		config.TTL = ttl
+	}
+	if value := os.Getenv("CACHE_MAX_ENTRIES"); value != "" {
+		maxEntries, err := strconv.Atoi(value)
+		if err != nil {
+			return config, fmt.Errorf("invalid CACHE_MAX_ENTRIES: %w", err)
+		}
+		config.MaxEntries = maxEntries
+	}
+	if value := os.Getenv("CACHE_STALE_GRACE_PERIOD"); value != "" {
+		gracePeriod, err := time.ParseDuration(value)
+		if err != nil {
+			return config, fmt.Errorf("invalid CACHE_STALE_GRACE_PERIOD: %w", err)
+		}
+		config.StaleGracePeriod = gracePeriod
+	}
+	return config, nil
+}
+
+// loadLogRedactor returns the redactor of the key IDs in the API paths of the log messages.
+func loadLogRedactor() (*redact.Redactor, error) {
+	mode := redact.ModeNone
+	if value := os.Getenv("LOG_REDACTION"); value != "" {
+		mode = redact.Mode(value)
+	}
+	redactor, err := redact.New(mode, []byte(os.Getenv("LOG_REDACTION_KEY")), redact.APIKeyPathPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LOG_REDACTION: %w", err)
+	}
+	return redactor, nil
+}
+
+// loadAuthConfig returns the file containing the accepted API tokens, which is empty if authentication is disabled,
+// and whether the health check requires authentication as well.
+func loadAuthConfig() (string, bool, error) {
+	protectHealth := false
+	if value := os.Getenv("AUTH_PROTECT_HEALTH"); value != "" {
+		var err error
+		if protectHealth, err = strconv.ParseBool(value); err != nil {
+			return "", false, fmt.Errorf("invalid AUTH_PROTECT_HEALTH: %w", err)
+		}
+	}
+	return os.Getenv("AUTH_TOKENS_FILE"), protectHealth, nil
+}
+
+// loadTLSConfig reads the TLS configuration of the API server, which is served over plain HTTP if no certificate is set.
+func loadTLSConfig() auth.TLSConfig {
+	return auth.TLSConfig{
+		CertFile:        os.Getenv("TLS_CERT_FILE"),
+		KeyFile:         os.Getenv("TLS_KEY_FILE"),
+		CAFile:          os.Getenv("TLS_CA_FILE"),
+		AllowedSubjects: splitList(os.Getenv("TLS_ALLOWED_SUBJECTS")),
+		AllowedSPKIPins: splitList(os.Getenv("TLS_ALLOWED_SPKI_PINS")),
+	}
+}
+
+// splitList splits a comma-separated list, ignoring empty elements.
+func splitList(value string) []string {
+	var result []string
+	for _, element := range strings.Split(value, ",") {
+		if element = strings.TrimSpace(element); element != "" {
+			result = append(result, element)
+		}
+	}
+	return result
+}
+
+// loadAuditLog returns the destination of the audit log, which is disabled if empty, and the key of its hashes.
+func loadAuditLog() (string, []byte) {
+	return os.Getenv("AUDIT_LOG"), []byte(os.Getenv("AUDIT_LOG_KEY"))
+}
+
+// loadAPIConfig reads the configuration of the API from the environment.
+func loadAPIConfig() (v1.Config, error) {
+	config := v1.DefaultConfig()
+	if value := os.Getenv("HEALTH_TOKEN_TTL_WARNING"); value != "" {
+		threshold, err := time.ParseDuration(value)
+		if err != nil {
+			return config, fmt.Errorf("invalid HEALTH_TOKEN_TTL_WARNING: %w", err)
+		}
+		config.TokenTTLWarningThreshold = threshold
+	}
+	if value := os.Getenv("HEALTH_TOKEN_USES_WARNING"); value != "" {
+		threshold, err := strconv.Atoi(value)
+		if err != nil {
+			return config, fmt.Errorf("invalid HEALTH_TOKEN_USES_WARNING: %w", err)
+		}
+		config.TokenUsesWarningThreshold = threshold
+	}
+	if value := os.Getenv("HEALTH_CHECK_CAPABILITIES"); value != "" {
+		checkCapabilities, err := strconv.ParseBool(value)
+		if err != nil {
+			return config, fmt.Errorf("invalid HEALTH_CHECK_CAPABILITIES: %w", err)
+		}
+		config.CheckCapabilities = checkCapabilities
+	}
+	return config, nil
+}
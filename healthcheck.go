@@ -0,0 +1,91 @@
+/*
+ * Copyright (C) 2023 Nuts community
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// healthCheckCommand is the command checking the health of the running proxy (e.g. by the Docker image), instead of starting it.
+const healthCheckCommand = "health-check"
+
+const healthCheckTimeout = 5 * time.Second
+
+// healthCheck requests the health check of the proxy listening on localhost and returns the exit code of the command.
+// It uses HTTPS if TLS is configured, presenting the client certificate of HEALTH_CHECK_CERT_FILE and HEALTH_CHECK_KEY_FILE,
+// which default to the server certificate and key. If HEALTH_CHECK_TOKEN_FILE is set, it sends the bearer token in that file,
+// which is needed when the health check requires authentication (AUTH_PROTECT_HEALTH).
+func healthCheck(args []string) int {
+	if len(args) != 0 {
+		_, _ = fmt.Fprintf(os.Stderr, "usage: %s %s\n", os.Args[0], healthCheckCommand)
+		return 2
+	}
+	client := &http.Client{Timeout: healthCheckTimeout}
+	url := "http://localhost" + listenAddress + "/health"
+	if tlsConfig := loadTLSConfig(); tlsConfig.Enabled() {
+		certFile, keyFile := os.Getenv("HEALTH_CHECK_CERT_FILE"), os.Getenv("HEALTH_CHECK_KEY_FILE")
+		if certFile == "" && keyFile == "" {
+			certFile, keyFile = tlsConfig.CertFile, tlsConfig.KeyFile
+		}
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "unable to load health check client certificate: %s\n", err)
+			return 1
+		}
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{
+			MinVersion:   tls.VersionTLS12,
+			Certificates: []tls.Certificate{certificate},
+			// the server certificate isn't issued for localhost, and the proxy on the loopback interface is trusted anyway
+			InsecureSkipVerify: true,
+		}}
+		url = "https://localhost" + listenAddress + "/health"
+	}
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "health check failed: %s\n", err)
+		return 1
+	}
+	if tokenFile := os.Getenv("HEALTH_CHECK_TOKEN_FILE"); tokenFile != "" {
+		token, err := os.ReadFile(tokenFile)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "unable to read health check token: %s\n", err)
+			return 1
+		}
+		request.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "health check failed: %s\n", err)
+		return 1
+	}
+	_ = response.Body.Close()
+	if response.StatusCode == http.StatusUnauthorized {
+		_, _ = fmt.Fprintf(os.Stderr, "health check failed: %s (set HEALTH_CHECK_TOKEN_FILE when AUTH_PROTECT_HEALTH is enabled)\n", response.Status)
+		return 1
+	}
+	if response.StatusCode != http.StatusOK {
+		_, _ = fmt.Fprintf(os.Stderr, "health check failed: %s\n", response.Status)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,66 @@
+/*
+ * Copyright (C) 2023 Nuts community
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package files
+
+import (
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Reloader holds a value loaded from files, which is loaded again when the files change.
+type Reloader[T any] struct {
+	name string
+	load func() (T, error)
+
+	mutex   sync.Mutex
+	watcher *Watcher
+	value   T
+	// reload is set when loading the changed files failed, so it is retried on the next call to Get
+	reload bool
+}
+
+// NewReloader loads the value from the given files using load. The name describes the value in log messages.
+func NewReloader[T any](name string, load func() (T, error), files ...string) (*Reloader[T], error) {
+	watcher := NewWatcher(files...)
+	value, err := load()
+	if err != nil {
+		return nil, err
+	}
+	return &Reloader[T]{name: name, load: load, watcher: watcher, value: value}, nil
+}
+
+// Get returns the value, after loading it again if the files changed.
+// If loading the changed files fails, the previous value is returned and loading is retried on the next call.
+func (r *Reloader[T]) Get() T {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.watcher.Changed() || r.reload {
+		value, err := r.load()
+		if err != nil {
+			// the files might be halfway through being replaced, keep using the current value for now
+			logrus.WithError(err).Warnf("Unable to reload %s, using the previous one", r.name)
+			r.reload = true
+		} else {
+			logrus.Infof("Reloaded %s", r.name)
+			r.value = value
+			r.reload = false
+		}
+	}
+	return r.value
+}
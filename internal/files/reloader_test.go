@@ -0,0 +1,69 @@
+/*
+ * Copyright (C) 2023 Nuts community
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package files
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReloader(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(file, []byte("a"), 0600))
+	load := func() (string, error) {
+		data, err := os.ReadFile(file)
+		if string(data) == "invalid" {
+			return "", errors.New("invalid contents")
+		}
+		return string(data), err
+	}
+	// write changes the file, making sure the change is detected even if the modification time is the same
+	write := func(t *testing.T, contents string, age time.Duration) {
+		require.NoError(t, os.WriteFile(file, []byte(contents), 0600))
+		require.NoError(t, os.Chtimes(file, time.Now(), time.Now().Add(age)))
+	}
+
+	reloader, err := NewReloader("test file", load, file)
+	require.NoError(t, err)
+	assert.Equal(t, "a", reloader.Get())
+
+	t.Run("reloads changed file", func(t *testing.T) {
+		write(t, "b", time.Minute)
+		assert.Equal(t, "b", reloader.Get())
+	})
+	t.Run("keeps the value if loading the changed file fails", func(t *testing.T) {
+		write(t, "invalid", 2*time.Minute)
+		assert.Equal(t, "b", reloader.Get())
+		assert.True(t, reloader.reload)
+	})
+	t.Run("retries loading on the next call", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(file, []byte("c"), 0600))
+		assert.Equal(t, "c", reloader.Get())
+		assert.False(t, reloader.reload)
+	})
+	t.Run("fails if the initial load fails", func(t *testing.T) {
+		_, err := NewReloader("test file", func() (string, error) { return "", errors.New("failure") }, file)
+		assert.EqualError(t, err, "failure")
+	})
+}
@@ -0,0 +1,69 @@
+/*
+ * Copyright (C) 2023 Nuts community
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package files detects changes to files, so they can be reloaded without restarting the proxy.
+package files
+
+import (
+	"os"
+	"time"
+)
+
+// Watcher detects changes to a set of files by comparing their modification time and size.
+// Symlinks are followed, so atomic updates through symlink swaps (like Kubernetes does for mounted secrets) are detected as well.
+type Watcher struct {
+	files []string
+	state []fileState
+}
+
+type fileState struct {
+	exists  bool
+	modTime time.Time
+	size    int64
+}
+
+// NewWatcher returns a Watcher of the given files, which don't have to exist.
+func NewWatcher(files ...string) *Watcher {
+	w := &Watcher{files: files}
+	w.state = w.stat()
+	return w
+}
+
+// Changed returns true if any of the files changed since the watcher was created or Changed was last called.
+func (w *Watcher) Changed() bool {
+	state := w.stat()
+	changed := false
+	for i := range state {
+		if state[i] != w.state[i] {
+			changed = true
+		}
+	}
+	w.state = state
+	return changed
+}
+
+func (w *Watcher) stat() []fileState {
+	state := make([]fileState, len(w.files))
+	for i, file := range w.files {
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		state[i] = fileState{exists: true, modTime: info.ModTime(), size: info.Size()}
+	}
+	return state
+}
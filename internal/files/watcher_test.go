@@ -0,0 +1,65 @@
+/*
+ * Copyright (C) 2023 Nuts community
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package files
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatcher(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	missing := filepath.Join(dir, "missing")
+	require.NoError(t, os.WriteFile(file, []byte("a"), 0600))
+	watcher := NewWatcher(file, missing)
+
+	assert.False(t, watcher.Changed(), "unchanged files")
+
+	t.Run("modified", func(t *testing.T) {
+		require.NoError(t, os.Chtimes(file, time.Now(), time.Now().Add(time.Minute)))
+		assert.True(t, watcher.Changed())
+		assert.False(t, watcher.Changed(), "change should only be reported once")
+	})
+	t.Run("created", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(missing, []byte("b"), 0600))
+		assert.True(t, watcher.Changed())
+	})
+	t.Run("symlink swapped", func(t *testing.T) {
+		target := filepath.Join(dir, "target")
+		link := filepath.Join(dir, "link")
+		require.NoError(t, os.WriteFile(target, []byte("c"), 0600))
+		require.NoError(t, os.Symlink(target, link))
+		watcher := NewWatcher(link)
+		newTarget := filepath.Join(dir, "new-target")
+		require.NoError(t, os.WriteFile(newTarget, []byte("rotated"), 0600))
+		require.NoError(t, os.Remove(link))
+		require.NoError(t, os.Symlink(newTarget, link))
+
+		assert.True(t, watcher.Changed())
+	})
+	t.Run("removed", func(t *testing.T) {
+		require.NoError(t, os.Remove(file))
+		assert.True(t, watcher.Changed())
+	})
+}
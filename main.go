@@ -18,9 +18,9 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
-	"net/url"
 	"os"
 
 	"github.com/labstack/echo/v4"
@@ -28,47 +28,141 @@ import (
 	"github.com/sirupsen/logrus"
 
 	v1 "github.com/nuts-foundation/hashicorp-vault-proxy/api/v1"
+	"github.com/nuts-foundation/hashicorp-vault-proxy/audit"
+	"github.com/nuts-foundation/hashicorp-vault-proxy/auth"
+	"github.com/nuts-foundation/hashicorp-vault-proxy/redact"
+	"github.com/nuts-foundation/hashicorp-vault-proxy/tracing"
 	"github.com/nuts-foundation/hashicorp-vault-proxy/vault"
 )
 
 const listenAddress = ":8210"
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == verifyAuditLogCommand {
+		os.Exit(verifyAuditLog(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == hashTokenCommand {
+		os.Exit(hashToken(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == healthCheckCommand {
+		os.Exit(healthCheck(os.Args[2:]))
+	}
+
+	var logFormatter logrus.Formatter
 	logFormat := os.Getenv("LOG_FORMAT")
 	switch logFormat {
 	case "json":
-		logrus.SetFormatter(&logrus.JSONFormatter{})
+		logFormatter = &logrus.JSONFormatter{}
 	default:
-		logrus.SetFormatter(&logrus.TextFormatter{})
+		logFormatter = &logrus.TextFormatter{}
 	}
+	redactor, err := loadLogRedactor()
+	if err != nil {
+		panic(fmt.Errorf("invalid configuration: %w", err))
+	}
+	logrus.SetFormatter(redact.Formatter{Formatter: logFormatter, Redactor: redactor})
 	logrus.Infof("Starting the Hashicorp Vault Proxy on %s", listenAddress)
 
-	// pathPrefix should always be set
-	pathPrefix := os.Getenv("VAULT_PATHPREFIX")
-	if pathPrefix == "" {
-		pathPrefix = "kv"
+	config, err := loadVaultConfig()
+	if err != nil {
+		panic(fmt.Errorf("invalid configuration: %w", err))
 	}
-
-	// pathName is optional
-	pathName, isSet := os.LookupEnv("VAULT_PATHNAME")
-	if !isSet {
-		pathName = "nuts-private-keys"
+	cacheConfig, err := loadCacheConfig()
+	if err != nil {
+		panic(fmt.Errorf("invalid configuration: %w", err))
 	}
-
-	// JoinPath will only add a slash if pathName is set
-	path, err := url.JoinPath(pathPrefix, pathName)
+	apiConfig, err := loadAPIConfig()
 	if err != nil {
-		panic(fmt.Errorf("unable to assemble vault secret path: %w", err))
+		panic(fmt.Errorf("invalid configuration: %w", err))
 	}
 
-	kv, err := vault.NewKVStore(path)
+	kv, err := vault.NewKVStore(config)
 	if err != nil {
 		panic(fmt.Errorf("unable to create Vault KVStore: %w", err))
 	}
+	// Vault paths (e.g. in errors) contain the key IDs as well
+	if keyPaths, ok := kv.(interface{ KeyPathPrefixes() []string }); ok {
+		logrus.SetFormatter(redact.Formatter{Formatter: logFormatter, Redactor: redactor.WithPathPrefixes(keyPaths.KeyPathPrefixes()...)})
+	}
+	storage := kv
+	if cacheConfig.Enabled() {
+		storage, err = vault.NewCachingStorage(kv, cacheConfig)
+		if err != nil {
+			panic(fmt.Errorf("invalid configuration: %w", err))
+		}
+		logrus.Infof("Caching secrets for %s (max. %d entries, stale grace period: %s)", cacheConfig.TTL, cacheConfig.MaxEntries, cacheConfig.StaleGracePeriod)
+	}
+
+	tokensFile, protectHealth, err := loadAuthConfig()
+	if err != nil {
+		panic(fmt.Errorf("invalid configuration: %w", err))
+	}
+	var tokens *auth.Tokens
+	if tokensFile != "" {
+		tokens, err = auth.LoadTokens(tokensFile)
+		if err != nil {
+			panic(fmt.Errorf("invalid configuration: %w", err))
+		}
+		logrus.Infof("Requiring bearer tokens for API requests (%d tokens, health check protected: %t)", tokens.Len(), protectHealth)
+	} else {
+		logrus.Warn("API authentication is disabled, anyone who can reach the proxy can access the secrets")
+	}
+
+	auditLog, auditHashKey := loadAuditLog()
+	if auditLog != "" {
+		auditor, closer, err := openAuditLog(auditLog, auditHashKey)
+		if err != nil {
+			panic(fmt.Errorf("invalid configuration: %w", err))
+		}
+		defer closer.Close()
+		apiConfig.Auditor = auditor
+		logrus.Infof("Writing audit log to %s", auditLog)
+	}
+
+	tlsConfig := loadTLSConfig()
+	var serverTLS *auth.ServerTLS
+	if tlsConfig.Enabled() {
+		serverTLS, err = auth.NewServerTLS(tlsConfig, apiConfig.Auditor)
+		if err != nil {
+			panic(fmt.Errorf("invalid configuration: %w", err))
+		}
+		logrus.Infof("Serving HTTPS, requiring client certificates (%d allowed subjects, %d allowed SPKI pins)", len(tlsConfig.AllowedSubjects), len(tlsConfig.AllowedSPKIPins))
+	}
 
-	handler := v1.NewStrictHandler(v1.NewWrapper(kv), nil)
+	handler := v1.NewStrictHandler(v1.NewWrapper(storage, apiConfig), nil)
 
 	e := echo.New()
+	// the remote IP is logged and audited, so it must not be taken from headers that can be set by the client
+	e.IPExtractor = echo.ExtractIPDirect()
+	if tracing.Enabled() {
+		exporter, err := tracing.NewOTLPExporter(context.Background())
+		if err != nil {
+			panic(fmt.Errorf("unable to create trace exporter: %w", err))
+		}
+		shutdown, err := tracing.Setup(context.Background(), exporter)
+		if err != nil {
+			panic(fmt.Errorf("unable to set up tracing: %w", err))
+		}
+		defer func() {
+			if err := shutdown(context.Background()); err != nil {
+				logrus.WithError(err).Warn("Unable to flush traces")
+			}
+		}()
+		e.Use(tracing.Middleware())
+		logrus.Info("Exporting traces over OTLP")
+	}
+	if auditLog != "" {
+		e.Use(audit.Middleware())
+	}
+	if adminListenAddress := loadAdminListenAddress(); adminListenAddress != "" {
+		requestMetrics := newHTTPMetrics()
+		registry, err := registerMetrics(storage, requestMetrics)
+		if err != nil {
+			panic(fmt.Errorf("unable to register metrics: %w", err))
+		}
+		e.Use(requestMetrics.middleware())
+		startAdminServer(adminListenAddress, registry)
+	}
 	e.Use(middleware.RequestLoggerWithConfig(middleware.RequestLoggerConfig{
 		Skipper: func(c echo.Context) bool {
 			return c.Path() == "/health"
@@ -99,10 +193,19 @@ func main() {
 			return nil
 		},
 	}))
+	if tokens != nil {
+		e.Use(v1.BearerAuth(tokens, protectHealth, apiConfig.Auditor))
+	}
 	e.HideBanner = true
 	e.HidePort = true
 	v1.RegisterHandlers(e, handler)
-	err = e.Start(listenAddress)
+	if serverTLS != nil {
+		e.TLSServer.Addr = listenAddress
+		e.TLSServer.TLSConfig = serverTLS.TLSConfig()
+		err = e.StartServer(e.TLSServer)
+	} else {
+		err = e.Start(listenAddress)
+	}
 	if err != nil {
 		panic(fmt.Errorf("unable to start server: %w", err))
 	}
@@ -0,0 +1,157 @@
+/*
+ * Copyright (C) 2023 Nuts community
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+
+	v1 "github.com/nuts-foundation/hashicorp-vault-proxy/api/v1"
+	"github.com/nuts-foundation/hashicorp-vault-proxy/vault"
+)
+
+// keyCountTimeout limits the time listing the keys may take when collecting the key count metric.
+const keyCountTimeout = 5 * time.Second
+
+// httpMetrics records the number and duration of the HTTP requests, per route (not per URI, to leave out the keys).
+type httpMetrics struct {
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+}
+
+func newHTTPMetrics() httpMetrics {
+	labels := []string{"method", "route", "status"}
+	return httpMetrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "vault_proxy",
+			Name:      "http_requests_total",
+			Help:      "Number of HTTP requests, per method, route and status code.",
+		}, labels),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "vault_proxy",
+			Name:      "http_request_duration_seconds",
+			Help:      "Duration of the HTTP requests, per method, route and status code.",
+			Buckets:   prometheus.DefBuckets,
+		}, labels),
+	}
+}
+
+// middleware returns the echo middleware recording the metrics of the requests.
+func (m httpMetrics) middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			err := next(c)
+			status := c.Response().Status
+			if err != nil {
+				var httpError *echo.HTTPError
+				if errors.As(err, &httpError) {
+					status = httpError.Code
+				} else {
+					status = http.StatusInternalServerError
+				}
+			}
+			route := c.Path()
+			if route == "" {
+				route = "unknown"
+			}
+			labels := prometheus.Labels{"method": c.Request().Method, "route": route, "status": strconv.Itoa(status)}
+			m.requests.With(labels).Inc()
+			m.duration.With(labels).Observe(time.Since(start).Seconds())
+			return err
+		}
+	}
+}
+
+// newKeyCountMetric returns a gauge which lists the keys in the storage every time it is collected.
+// It reports NaN if the keys can't be listed. Listing the keys bypasses the limit on concurrent Vault requests,
+// so scrapes don't fail while the proxy is busy.
+func newKeyCountMetric(storage vault.Storage) prometheus.Collector {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "vault_proxy",
+		Name:      "keys",
+		Help:      "Number of keys in the storage.",
+	}, func() float64 {
+		ctx, cancel := context.WithTimeout(vault.WithoutLimit(context.Background()), keyCountTimeout)
+		defer cancel()
+		keys, err := storage.ListKeys(ctx)
+		if err != nil {
+			logrus.WithError(err).Warn("Unable to list keys for the key count metric")
+			return math.NaN()
+		}
+		return float64(len(keys))
+	})
+}
+
+// registerMetrics registers all metrics of the proxy in a new registry.
+func registerMetrics(storage vault.Storage, requests httpMetrics) (*prometheus.Registry, error) {
+	registry := prometheus.NewRegistry()
+	all := []prometheus.Collector{
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		requests.requests,
+		requests.duration,
+		newKeyCountMetric(storage),
+	}
+	// the storage backend and cache report their state (e.g. of the circuit breaker) if they support it
+	for s := storage; s != nil; {
+		if collector, ok := s.(prometheus.Collector); ok {
+			all = append(all, collector)
+		}
+		cache, ok := s.(*vault.CachingStorage)
+		if !ok {
+			break
+		}
+		s = cache.Storage
+	}
+	for _, collector := range all {
+		if err := registry.Register(collector); err != nil {
+			return nil, err
+		}
+	}
+	if err := vault.RegisterMetrics(registry); err != nil {
+		return nil, err
+	}
+	if err := v1.RegisterMetrics(registry); err != nil {
+		return nil, err
+	}
+	return registry, nil
+}
+
+// startAdminServer serves the metrics on the admin address, separate from the API.
+func startAdminServer(address string, registry *prometheus.Registry) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	server := &http.Server{Addr: address, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		logrus.Infof("Serving metrics on %s/metrics", address)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logrus.WithError(err).Error("Admin server failed")
+		}
+	}()
+}
@@ -0,0 +1,142 @@
+/*
+ * Copyright (C) 2023 Nuts community
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package redact removes the key IDs from log messages, replacing them by a keyed hash or a placeholder.
+package redact
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Mode specifies how key IDs are redacted.
+type Mode string
+
+const (
+	// ModeNone doesn't redact key IDs.
+	ModeNone Mode = "none"
+	// ModeHash replaces key IDs by a keyed hash, so log lines about the same key can still be correlated.
+	ModeHash Mode = "hash"
+	// ModePlaceholder replaces key IDs by a fixed placeholder.
+	ModePlaceholder Mode = "placeholder"
+)
+
+// Placeholder replaces the key IDs in ModePlaceholder.
+const Placeholder = "redacted"
+
+// APIKeyPathPrefix is the path of the API under which the key ID is the last segment.
+const APIKeyPathPrefix = "/secrets"
+
+// Redactor replaces the key IDs following one of the configured path prefixes.
+type Redactor struct {
+	mode     Mode
+	hashKey  []byte
+	prefixes []string
+	pattern  *regexp.Regexp
+}
+
+// New returns a Redactor replacing the path segment following one of the given path prefixes, e.g. /secrets for /secrets/{key}.
+// The hash key is required for ModeHash.
+func New(mode Mode, hashKey []byte, pathPrefixes ...string) (*Redactor, error) {
+	switch mode {
+	case ModeNone, ModePlaceholder:
+	case ModeHash:
+		if len(hashKey) == 0 {
+			return nil, errors.New("a hash key is required to redact key IDs by their hash")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported redaction mode: %s", mode)
+	}
+	return (&Redactor{mode: mode, hashKey: hashKey}).WithPathPrefixes(pathPrefixes...), nil
+}
+
+// WithPathPrefixes returns a Redactor which also replaces the path segment following the given path prefixes.
+func (r *Redactor) WithPathPrefixes(pathPrefixes ...string) *Redactor {
+	result := &Redactor{mode: r.mode, hashKey: r.hashKey, prefixes: append([]string(nil), r.prefixes...)}
+	for _, prefix := range pathPrefixes {
+		prefix = strings.Trim(prefix, "/")
+		if prefix != "" && prefix != "." {
+			result.prefixes = append(result.prefixes, prefix)
+		}
+	}
+	if len(result.prefixes) > 0 {
+		alternatives := make([]string, len(result.prefixes))
+		for i, prefix := range result.prefixes {
+			alternatives[i] = regexp.QuoteMeta(prefix)
+		}
+		// the prefix must start at a path segment, the key ends at the end of the segment, query or quoted string
+		result.pattern = regexp.MustCompile(`(^|[/\s"'=])((?:` + strings.Join(alternatives, "|") + `)/)([^\s"'?/]+)`)
+	}
+	return result
+}
+
+// Redact returns the message with the key IDs replaced.
+func (r *Redactor) Redact(message string) string {
+	if r.mode == ModeNone || r.pattern == nil {
+		return message
+	}
+	return r.pattern.ReplaceAllStringFunc(message, func(match string) string {
+		groups := r.pattern.FindStringSubmatch(match)
+		return groups[1] + groups[2] + r.replacement(groups[3])
+	})
+}
+
+func (r *Redactor) replacement(key string) string {
+	if r.mode == ModePlaceholder {
+		return Placeholder
+	}
+	// keys appear both escaped (in URLs) and unescaped, which should result in the same hash
+	if unescaped, err := url.PathUnescape(key); err == nil {
+		key = unescaped
+	}
+	mac := hmac.New(sha256.New, r.hashKey)
+	mac.Write([]byte(key))
+	return Placeholder + "-" + hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// Formatter is a logrus.Formatter which redacts the key IDs from the message and fields (including errors) of the log entries.
+type Formatter struct {
+	logrus.Formatter
+	Redactor *Redactor
+}
+
+// Format implements logrus.Formatter.
+func (f Formatter) Format(entry *logrus.Entry) ([]byte, error) {
+	redacted := *entry
+	redacted.Message = f.Redactor.Redact(entry.Message)
+	redacted.Data = make(logrus.Fields, len(entry.Data))
+	for name, value := range entry.Data {
+		switch v := value.(type) {
+		case string:
+			value = f.Redactor.Redact(v)
+		case error:
+			value = f.Redactor.Redact(v.Error())
+		case fmt.Stringer:
+			value = f.Redactor.Redact(v.String())
+		}
+		redacted.Data[name] = value
+	}
+	return f.Formatter.Format(&redacted)
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright (C) 2023 Nuts community
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package redact
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const key = "did:nuts:123#key-1"
+
+var vaultPrefixes = []string{"kv/data/nuts-private-keys", "kv/metadata/nuts-private-keys"}
+
+func TestRedactor_Redact(t *testing.T) {
+	redactor, err := New(ModePlaceholder, nil, APIKeyPathPrefix)
+	require.NoError(t, err)
+	redactor = redactor.WithPathPrefixes(vaultPrefixes...)
+
+	testCases := map[string]string{
+		"/secrets/did:nuts:123%23key-1":         "/secrets/redacted",
+		"/secrets/did:nuts:123%23key-1?foo=bar": "/secrets/redacted?foo=bar",
+		"/secrets":                              "/secrets",
+		`unable to read key from vault: vault is unavailable: Get "http://vault:8200/v1/kv/data/nuts-private-keys/did:nuts:123%23key-1": connection refused`: `unable to read key from vault: vault is unavailable: Get "http://vault:8200/v1/kv/data/nuts-private-keys/redacted": connection refused`,
+		"Error making API request.\n\nURL: DELETE http://vault:8200/v1/kv/metadata/nuts-private-keys/did:nuts:123%23key-1\nCode: 503":                        "Error making API request.\n\nURL: DELETE http://vault:8200/v1/kv/metadata/nuts-private-keys/redacted\nCode: 503",
+		"Vault read of kv/data/nuts-private-keys/" + key + " failed (attempt 1 of 3)":                                                                        "Vault read of kv/data/nuts-private-keys/redacted failed (attempt 1 of 3)",
+		"GET http://vault:8200/v1/kv/metadata/nuts-private-keys?list=true":                                                                                   "GET http://vault:8200/v1/kv/metadata/nuts-private-keys?list=true",
+		"/other/secrets/" + key:              "/other/secrets/redacted",
+		"mykv/data/nuts-private-keys/" + key: "mykv/data/nuts-private-keys/" + key,
+	}
+	for message, expected := range testCases {
+		assert.Equal(t, expected, redactor.Redact(message))
+	}
+}
+
+func TestRedactor_modes(t *testing.T) {
+	t.Run("hash", func(t *testing.T) {
+		redactor, err := New(ModeHash, []byte("secret"), APIKeyPathPrefix)
+		require.NoError(t, err)
+
+		escaped := redactor.Redact("/secrets/did:nuts:123%23key-1")
+		unescaped := redactor.Redact("/secrets/" + key)
+		other := redactor.Redact("/secrets/did:nuts:123%23key-2")
+
+		assert.Regexp(t, `^/secrets/redacted-[0-9a-f]{16}$`, escaped)
+		assert.Equal(t, escaped, unescaped, "escaped and unescaped keys should have the same hash")
+		assert.NotEqual(t, escaped, other)
+		otherKey, _ := New(ModeHash, []byte("other"), APIKeyPathPrefix)
+		assert.NotEqual(t, escaped, otherKey.Redact("/secrets/"+key), "hash should depend on the hash key")
+	})
+	t.Run("none", func(t *testing.T) {
+		redactor, err := New(ModeNone, nil, APIKeyPathPrefix)
+		require.NoError(t, err)
+
+		assert.Equal(t, "/secrets/"+key, redactor.Redact("/secrets/"+key))
+	})
+	t.Run("hash without key", func(t *testing.T) {
+		_, err := New(ModeHash, nil)
+
+		assert.EqualError(t, err, "a hash key is required to redact key IDs by their hash")
+	})
+	t.Run("unsupported", func(t *testing.T) {
+		_, err := New("mask", nil)
+
+		assert.EqualError(t, err, "unsupported redaction mode: mask")
+	})
+}
+
+func TestFormatter(t *testing.T) {
+	redactor, err := New(ModePlaceholder, nil, APIKeyPathPrefix)
+	require.NoError(t, err)
+	buf := &bytes.Buffer{}
+	logger := logrus.New()
+	logger.SetOutput(buf)
+	logger.SetFormatter(Formatter{Formatter: &logrus.JSONFormatter{DisableTimestamp: true}, Redactor: redactor})
+	fields := logrus.Fields{"uri": "/secrets/" + key, "status": 200}
+
+	logger.WithFields(fields).WithError(errors.New("failed on /secrets/"+key)).Infof("Request to /secrets/%s", key)
+
+	assert.JSONEq(t, `{
+		"level": "info",
+		"msg": "Request to /secrets/redacted",
+		"uri": "/secrets/redacted",
+		"status": 200,
+		"error": "failed on /secrets/redacted"
+	}`, buf.String())
+	assert.Equal(t, "/secrets/"+key, fields["uri"], "fields of the entry should not be modified")
+}
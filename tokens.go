@@ -0,0 +1,50 @@
+/*
+ * Copyright (C) 2023 Nuts community
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/nuts-foundation/hashicorp-vault-proxy/auth"
+)
+
+// hashTokenCommand is the command printing the token file line of a token read from stdin, instead of starting the proxy.
+const hashTokenCommand = "hash-token"
+
+// hashToken prints the token file line accepting the token read from stdin, and returns the exit code of the command.
+func hashToken(args []string) int {
+	if len(args) != 1 {
+		_, _ = fmt.Fprintf(os.Stderr, "usage: %s %s <name> < token\n", os.Args[0], hashTokenCommand)
+		return 2
+	}
+	token, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && token == "" {
+		_, _ = fmt.Fprintf(os.Stderr, "unable to read token from stdin: %s\n", err)
+		return 1
+	}
+	line, err := auth.HashToken(args[0], strings.TrimSpace(token))
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println(line)
+	return 0
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright (C) 2023 Nuts community
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestMiddleware(t *testing.T) {
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	const parentID = "00f067aa0ba902b7"
+	exporter := tracetest.NewInMemoryExporter()
+	shutdown, err := Setup(context.Background(), keepingExporter{exporter})
+	require.NoError(t, err)
+	e := echo.New()
+	e.Use(Middleware())
+	var handlerSpan trace.SpanContext
+	e.GET("/secrets/:key", func(c echo.Context) error {
+		handlerSpan = trace.SpanContextFromContext(c.Request().Context())
+		return c.NoContent(http.StatusNotFound)
+	})
+	e.POST("/secrets", func(c echo.Context) error {
+		return echo.NewHTTPError(http.StatusServiceUnavailable)
+	})
+
+	request := httptest.NewRequest(http.MethodGet, "/secrets/my-key", nil)
+	request.Header.Set("traceparent", "00-"+traceID+"-"+parentID+"-01")
+	e.ServeHTTP(httptest.NewRecorder(), request)
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/secrets", nil))
+	require.NoError(t, shutdown(context.Background()))
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 2)
+	t.Run("continues the trace of the request", func(t *testing.T) {
+		span := spans[0]
+		assert.Equal(t, "GET /secrets/:key", span.Name)
+		assert.Equal(t, trace.SpanKindServer, span.SpanKind)
+		assert.Equal(t, traceID, span.SpanContext.TraceID().String())
+		assert.Equal(t, parentID, span.Parent.SpanID().String())
+		assert.Equal(t, span.SpanContext, handlerSpan)
+	})
+	t.Run("records the route instead of the key", func(t *testing.T) {
+		assert.ElementsMatch(t, []attribute.KeyValue{
+			attribute.String("http.request.method", http.MethodGet),
+			attribute.String("http.route", "/secrets/:key"),
+			attribute.Int("http.response.status_code", http.StatusNotFound),
+		}, spans[0].Attributes)
+		assert.Equal(t, codes.Unset, spans[0].Status.Code)
+	})
+	t.Run("records server errors", func(t *testing.T) {
+		span := spans[1]
+		assert.Equal(t, "POST /secrets", span.Name)
+		assert.False(t, span.Parent.IsValid())
+		assert.Contains(t, span.Attributes, attribute.Int("http.response.status_code", http.StatusServiceUnavailable))
+		assert.Equal(t, codes.Error, span.Status.Code)
+	})
+	t.Run("service name", func(t *testing.T) {
+		assert.Contains(t, spans[0].Resource.Attributes(), attribute.String("service.name", serviceName))
+	})
+}
+
+// keepingExporter keeps the spans on shutdown, which flushes the spans to the exporter.
+type keepingExporter struct {
+	*tracetest.InMemoryExporter
+}
+
+func (keepingExporter) Shutdown(context.Context) error {
+	return nil
+}
@@ -0,0 +1,455 @@
+/*
+ * Copyright (C) 2023 Nuts community
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package vault
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	"github.com/sirupsen/logrus"
+
+	"github.com/nuts-foundation/hashicorp-vault-proxy/internal/files"
+)
+
+// fileWatchInterval is how often credential files are checked for changes.
+var fileWatchInterval = 10 * time.Second
+
+// Supported auth methods for obtaining the Vault token.
+const (
+	// AuthMethodToken uses the token from the VAULT_TOKEN environment variable.
+	AuthMethodToken = "token"
+	// AuthMethodAppRole logs in using a role ID and secret ID: https://developer.hashicorp.com/vault/docs/auth/approle
+	AuthMethodAppRole = "approle"
+	// AuthMethodKubernetes logs in using a Kubernetes service account token: https://developer.hashicorp.com/vault/docs/auth/kubernetes
+	AuthMethodKubernetes = "kubernetes"
+	// AuthMethodJWT logs in using a JWT, e.g. a workload identity token: https://developer.hashicorp.com/vault/docs/auth/jwt
+	AuthMethodJWT = "jwt"
+	// AuthMethodCert logs in using a TLS client certificate: https://developer.hashicorp.com/vault/docs/auth/cert
+	AuthMethodCert = "cert"
+)
+
+// defaultServiceAccountTokenFile is where Kubernetes mounts the service account token in pods.
+const defaultServiceAccountTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// loginRetryInterval is the time to wait before retrying a failed login.
+var loginRetryInterval = 10 * time.Second
+
+// AuthConfig contains the settings for obtaining the Vault token.
+type AuthConfig struct {
+	// Method is the auth method used to log in to Vault. If empty, AuthMethodToken is used.
+	Method string
+	// MountPath is the path the auth method is mounted on. If empty, the default mount path of the auth method is used.
+	MountPath string
+	// AppRole contains the settings for AuthMethodAppRole.
+	AppRole AppRoleConfig
+	// Kubernetes contains the settings for AuthMethodKubernetes.
+	Kubernetes KubernetesConfig
+	// JWT contains the settings for AuthMethodJWT.
+	JWT JWTConfig
+	// Cert contains the settings for AuthMethodCert.
+	Cert CertConfig
+}
+
+// AppRoleConfig contains the settings for the AppRole auth method.
+type AppRoleConfig struct {
+	// RoleID is the role ID of the AppRole.
+	RoleID string
+	// SecretID is the secret ID of the AppRole. Ignored if SecretIDFile is set.
+	SecretID string
+	// SecretIDFile is the path of a file containing the secret ID. It is read on every login.
+	SecretIDFile string
+}
+
+// KubernetesConfig contains the settings for the Kubernetes auth method.
+type KubernetesConfig struct {
+	// Role is the name of the Vault role the service account is bound to.
+	Role string
+	// TokenFile is the path of the service account token. If empty, the token Kubernetes mounts in the pod is used.
+	TokenFile string
+}
+
+// JWTConfig contains the settings for the JWT auth method.
+type JWTConfig struct {
+	// Role is the name of the Vault role to log in with. If empty, the default role of the auth method is used.
+	Role string
+	// TokenFile is the path of the file containing the JWT.
+	TokenFile string
+}
+
+// CertConfig contains the settings for the TLS certificate auth method.
+type CertConfig struct {
+	// Role is the name of the certificate role to log in with. If empty, Vault tries all roles matching the certificate.
+	Role string
+	// CertFile is the path of the PEM encoded client certificate.
+	CertFile string
+	// KeyFile is the path of the PEM encoded private key of the client certificate.
+	KeyFile string
+}
+
+// credentialFileMethod is implemented by auth methods that read their credentials from files.
+// The authenticator logs in again when one of these files changes, e.g. because the credentials were rotated.
+type credentialFileMethod interface {
+	credentialFiles() []string
+}
+
+// newAuthMethod creates the auth method for the given config. It returns nil if the token from the environment should be used.
+func newAuthMethod(config AuthConfig) (vaultapi.AuthMethod, error) {
+	mountPath := func(defaultPath string) string {
+		if config.MountPath != "" {
+			return strings.Trim(config.MountPath, "/")
+		}
+		return defaultPath
+	}
+	switch config.Method {
+	case "", AuthMethodToken:
+		return nil, nil
+	case AuthMethodAppRole:
+		if config.AppRole.RoleID == "" {
+			return nil, errors.New("AppRole auth method requires a role ID")
+		}
+		if config.AppRole.SecretID == "" && config.AppRole.SecretIDFile == "" {
+			return nil, errors.New("AppRole auth method requires a secret ID or secret ID file")
+		}
+		return appRoleAuth{mountPath: mountPath("approle"), config: config.AppRole}, nil
+	case AuthMethodKubernetes:
+		if config.Kubernetes.Role == "" {
+			return nil, errors.New("Kubernetes auth method requires a role")
+		}
+		tokenFile := config.Kubernetes.TokenFile
+		if tokenFile == "" {
+			tokenFile = defaultServiceAccountTokenFile
+		}
+		return kubernetesAuth{mountPath: mountPath("kubernetes"), role: config.Kubernetes.Role, tokenFile: tokenFile}, nil
+	case AuthMethodJWT:
+		if config.JWT.TokenFile == "" {
+			return nil, errors.New("JWT auth method requires a token file")
+		}
+		return jwtAuth{mountPath: mountPath("jwt"), config: config.JWT}, nil
+	case AuthMethodCert:
+		if config.Cert.CertFile == "" || config.Cert.KeyFile == "" {
+			return nil, errors.New("cert auth method requires a certificate and key file")
+		}
+		certificate, err := loadClientCertificate(config.Cert.CertFile, config.Cert.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		return certAuth{mountPath: mountPath("cert"), role: config.Cert.Role, certificate: certificate}, nil
+	default:
+		return nil, fmt.Errorf("unsupported auth method: %s", config.Method)
+	}
+}
+
+// authenticator keeps the Vault token of the client alive, so users of the client don't need to care how the token was obtained.
+// Renewable tokens are renewed before they expire. If a token can't be renewed (any further), it logs in again using the auth method.
+type authenticator struct {
+	client *vaultapi.Client
+	// method is the auth method used to log in. If nil, the token the client was configured with is used and can't be replaced.
+	method vaultapi.AuthMethod
+}
+
+// login logs in using the auth method and sets the resulting token on the client.
+func (a authenticator) login(ctx context.Context) (*vaultapi.Secret, error) {
+	secret, err := a.client.Auth().Login(ctx, a.method)
+	if err != nil {
+		return nil, fmt.Errorf("unable to log in to Vault: %w", err)
+	}
+	return secret, nil
+}
+
+// lookupToken looks up the token the client was configured with, and returns it in the form of a login secret so it can be kept alive by run.
+func (a authenticator) lookupToken() (*vaultapi.Secret, error) {
+	lookup, err := a.client.Auth().Token().LookupSelf()
+	if err != nil {
+		return nil, fmt.Errorf("unable to look up Vault token: %w", err)
+	}
+	if lookup == nil {
+		return nil, errors.New("unable to look up Vault token: empty response")
+	}
+	ttl, err := lookup.TokenTTL()
+	if err != nil {
+		return nil, fmt.Errorf("unable to look up Vault token: %w", err)
+	}
+	renewable, err := lookup.TokenIsRenewable()
+	if err != nil {
+		return nil, fmt.Errorf("unable to look up Vault token: %w", err)
+	}
+	return &vaultapi.Secret{Auth: &vaultapi.SecretAuth{
+		ClientToken:   a.client.Token(),
+		Renewable:     renewable,
+		LeaseDuration: int(ttl.Seconds()),
+	}}, nil
+}
+
+// run keeps the token of the given login secret alive until the context is cancelled.
+// It logs in again when the token can't be renewed any further or when the credentials of the auth method change on disk,
+// after which the previous token is revoked. Failed logins are retried, since the current token might still be valid for a while.
+func (a authenticator) run(ctx context.Context, secret *vaultapi.Secret) {
+	var watcher *files.Watcher
+	var poll <-chan time.Time
+	if method, ok := a.method.(credentialFileMethod); ok {
+		watcher = files.NewWatcher(method.credentialFiles()...)
+		ticker := time.NewTicker(fileWatchInterval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+	var relogin <-chan time.Time
+	stopRenewal := func() {}
+	defer func() {
+		stopRenewal()
+	}()
+	for {
+		if secret != nil {
+			stopRenewal()
+			relogin, stopRenewal = a.keepAlive(secret)
+			secret = nil
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-relogin:
+			if a.method == nil {
+				logrus.Error("Vault token can't be renewed any further and will expire, configure an auth method to log in again automatically")
+				return
+			}
+			logrus.Info("Vault token can't be renewed any further, logging in again...")
+		case <-poll:
+			if !watcher.Changed() {
+				continue
+			}
+			logrus.Info("Vault credentials changed on disk, logging in again...")
+		}
+		previousToken := a.client.Token()
+		newSecret, err := a.login(ctx)
+		if err != nil {
+			logrus.WithError(err).Errorf("Vault login failed, retrying in %s", loginRetryInterval)
+			relogin = after(loginRetryInterval)
+			continue
+		}
+		// stop renewing the previous token before revoking it
+		stopRenewal()
+		a.revoke(ctx, previousToken)
+		secret = newSecret
+	}
+}
+
+// revoke revokes the given token after it was replaced by logging in again, so it can't be used anymore (e.g. after it leaked).
+// Failing to revoke it doesn't affect the new token, so it is only logged.
+func (a authenticator) revoke(ctx context.Context, token string) {
+	if token == "" || token == a.client.Token() {
+		return
+	}
+	client, err := a.client.Clone()
+	if err != nil {
+		logrus.WithError(err).Warn("Unable to revoke the previous Vault token, it stays valid until it expires")
+		return
+	}
+	client.SetToken(token)
+	if err := client.Auth().Token().RevokeSelfWithContext(ctx, ""); err != nil {
+		logrus.WithError(err).Warn("Unable to revoke the previous Vault token, it stays valid until it expires")
+		return
+	}
+	logrus.Info("Revoked the previous Vault token")
+}
+
+// keepAlive renews the token of the given login secret in the background if it is renewable.
+// The returned channel receives when the token should be replaced by logging in again: when it can't be renewed any further,
+// or well before it expires if it isn't renewable. The returned function stops the renewal.
+func (a authenticator) keepAlive(secret *vaultapi.Secret) (<-chan time.Time, func()) {
+	ttl := tokenTTL(secret)
+	if ttl == 0 {
+		logrus.Info("Vault token does not expire")
+		return nil, func() {}
+	}
+	if !secret.Auth.Renewable {
+		logrus.Infof("Vault token is not renewable and expires in %s", ttl)
+		return after(reloginDelay(secret)), func() {}
+	}
+	watcher, err := a.client.NewLifetimeWatcher(&vaultapi.LifetimeWatcherInput{Secret: secret})
+	if err != nil {
+		logrus.WithError(err).Warnf("Unable to renew Vault token, it expires in %s", ttl)
+		return after(reloginDelay(secret)), func() {}
+	}
+	expiring := make(chan time.Time, 1)
+	go watcher.Start()
+	go func() {
+		for {
+			select {
+			case err := <-watcher.DoneCh():
+				if err != nil {
+					logrus.WithError(err).Warn("Vault token renewal failed")
+				}
+				expiring <- time.Now()
+				return
+			case renewal := <-watcher.RenewCh():
+				logrus.Infof("Renewed Vault token, it expires in %s", tokenTTL(renewal.Secret))
+			}
+		}
+	}()
+	return expiring, watcher.Stop
+}
+
+// after is like time.After, but returns a nil channel (which blocks forever) if the duration isn't positive.
+func after(duration time.Duration) <-chan time.Time {
+	if duration <= 0 {
+		return nil
+	}
+	return time.After(duration)
+}
+
+// reloginDelay returns how long to wait before logging in again, which is well before the token expires
+// (like Vault's lifetime watcher does when renewing). It returns 0 if there's no need to log in again.
+func reloginDelay(secret *vaultapi.Secret) time.Duration {
+	return tokenTTL(secret) * 2 / 3
+}
+
+// tokenTTL returns the time-to-live of the token obtained by a login. It returns 0 if the token doesn't expire.
+func tokenTTL(secret *vaultapi.Secret) time.Duration {
+	if secret == nil || secret.Auth == nil {
+		return 0
+	}
+	return time.Duration(secret.Auth.LeaseDuration) * time.Second
+}
+
+// appRoleAuth implements vaultapi.AuthMethod for the AppRole auth method.
+type appRoleAuth struct {
+	mountPath string
+	config    AppRoleConfig
+}
+
+func (a appRoleAuth) Login(ctx context.Context, client *vaultapi.Client) (*vaultapi.Secret, error) {
+	secretID := a.config.SecretID
+	if a.config.SecretIDFile != "" {
+		data, err := os.ReadFile(a.config.SecretIDFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read AppRole secret ID: %w", err)
+		}
+		secretID = strings.TrimSpace(string(data))
+	}
+	return client.Logical().WriteWithContext(ctx, fmt.Sprintf("auth/%s/login", a.mountPath), map[string]interface{}{
+		"role_id":   a.config.RoleID,
+		"secret_id": secretID,
+	})
+}
+
+func (a appRoleAuth) credentialFiles() []string {
+	if a.config.SecretIDFile == "" {
+		return nil
+	}
+	return []string{a.config.SecretIDFile}
+}
+
+// kubernetesAuth implements vaultapi.AuthMethod for the Kubernetes auth method.
+type kubernetesAuth struct {
+	mountPath string
+	role      string
+	tokenFile string
+}
+
+func (k kubernetesAuth) Login(ctx context.Context, client *vaultapi.Client) (*vaultapi.Secret, error) {
+	// Kubernetes rotates projected service account tokens, so the token is read on every login
+	jwt, err := os.ReadFile(k.tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read Kubernetes service account token: %w", err)
+	}
+	return client.Logical().WriteWithContext(ctx, fmt.Sprintf("auth/%s/login", k.mountPath), map[string]interface{}{
+		"role": k.role,
+		"jwt":  strings.TrimSpace(string(jwt)),
+	})
+}
+
+func (k kubernetesAuth) credentialFiles() []string {
+	return []string{k.tokenFile}
+}
+
+// jwtAuth implements vaultapi.AuthMethod for the JWT auth method.
+type jwtAuth struct {
+	mountPath string
+	config    JWTConfig
+}
+
+func (j jwtAuth) Login(ctx context.Context, client *vaultapi.Client) (*vaultapi.Secret, error) {
+	jwt, err := os.ReadFile(j.config.TokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read JWT: %w", err)
+	}
+	data := map[string]interface{}{
+		"jwt": strings.TrimSpace(string(jwt)),
+	}
+	if j.config.Role != "" {
+		data["role"] = j.config.Role
+	}
+	return client.Logical().WriteWithContext(ctx, fmt.Sprintf("auth/%s/login", j.mountPath), data)
+}
+
+func (j jwtAuth) credentialFiles() []string {
+	return []string{j.config.TokenFile}
+}
+
+// certAuth implements vaultapi.AuthMethod for the TLS certificate auth method.
+// The client certificate itself is presented during the TLS handshake, see configureVaultClient.
+type certAuth struct {
+	mountPath   string
+	role        string
+	certificate *clientCertificate
+}
+
+func (c certAuth) Login(ctx context.Context, client *vaultapi.Client) (*vaultapi.Secret, error) {
+	// Connections are kept alive, so close them to make sure the login is done with the current certificate
+	client.CloneConfig().HttpClient.CloseIdleConnections()
+	data := map[string]interface{}{}
+	if c.role != "" {
+		data["name"] = c.role
+	}
+	return client.Logical().WriteWithContext(ctx, fmt.Sprintf("auth/%s/login", c.mountPath), data)
+}
+
+func (c certAuth) credentialFiles() []string {
+	return []string{c.certificate.certFile, c.certificate.keyFile}
+}
+
+// clientCertificate provides a TLS client certificate loaded from disk, which is loaded again when the files change.
+type clientCertificate struct {
+	certFile    string
+	keyFile     string
+	certificate *files.Reloader[*tls.Certificate]
+}
+
+func loadClientCertificate(certFile, keyFile string) (*clientCertificate, error) {
+	certificate, err := files.NewReloader("Vault client certificate", func() (*tls.Certificate, error) {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %w", err)
+		}
+		return &certificate, nil
+	}, certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &clientCertificate{certFile: certFile, keyFile: keyFile, certificate: certificate}, nil
+}
+
+// get implements tls.Config.GetClientCertificate.
+func (c *clientCertificate) get(_ *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return c.certificate.Get(), nil
+}
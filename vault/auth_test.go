@@ -0,0 +1,582 @@
+/*
+ * Copyright (C) 2023 Nuts community
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package vault
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeVault is a minimal Vault HTTP server that accepts logins on a single login path, and supports token lookup, renewal and revocation.
+type fakeVault struct {
+	*httptest.Server
+	mutex sync.Mutex
+	// loginPath is the path on which logins are accepted, e.g. /v1/auth/approle/login
+	loginPath string
+	// checkLogin validates the login request body, returning an error to reject the login
+	checkLogin func(body map[string]interface{}) error
+	// leaseDuration is the TTL in seconds of the issued tokens
+	leaseDuration int
+	// renewable indicates whether the issued tokens are renewable
+	renewable bool
+	// denyRenewal makes token renewals fail with permission denied
+	denyRenewal bool
+	// denyRevocation makes token revocations fail with permission denied
+	denyRevocation bool
+	logins         int
+	renewals       int
+	// revoked contains the revoked tokens
+	revoked []string
+	// clientCertificate is the common name of the TLS client certificate presented with the last request
+	clientCertificate string
+}
+
+func newFakeVault(t *testing.T, loginPath string, checkLogin func(body map[string]interface{}) error) *fakeVault {
+	f := &fakeVault{loginPath: loginPath, checkLogin: checkLogin, leaseDuration: 3600}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.handle))
+	t.Cleanup(f.Server.Close)
+	return f
+}
+
+func (f *fakeVault) handle(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		f.clientCertificate = r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	writeError := func(status int, message string) {
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"errors": []string{message}})
+	}
+	switch {
+	case r.URL.Path == f.loginPath && r.Method == http.MethodPut:
+		var body map[string]interface{}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		if err := f.checkLogin(body); err != nil {
+			writeError(http.StatusBadRequest, err.Error())
+			return
+		}
+		f.logins++
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"auth": f.tokenAuth(fmt.Sprintf("token-%d", f.logins))})
+	case r.URL.Path == "/v1/auth/token/renew-self" && r.Method == http.MethodPut:
+		if f.denyRenewal {
+			writeError(http.StatusForbidden, "permission denied")
+			return
+		}
+		f.renewals++
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"auth": f.tokenAuth(r.Header.Get("X-Vault-Token"))})
+	case r.URL.Path == "/v1/auth/token/revoke-self" && r.Method == http.MethodPut:
+		if f.denyRevocation {
+			writeError(http.StatusForbidden, "permission denied")
+			return
+		}
+		f.revoked = append(f.revoked, r.Header.Get("X-Vault-Token"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.URL.Path == "/v1/auth/token/lookup-self" && r.Method == http.MethodGet:
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{
+			"id":        r.Header.Get("X-Vault-Token"),
+			"ttl":       f.leaseDuration,
+			"renewable": f.renewable,
+		}})
+	default:
+		writeError(http.StatusNotFound, "not found")
+	}
+}
+
+func (f *fakeVault) tokenAuth(token string) map[string]interface{} {
+	return map[string]interface{}{
+		"client_token":   token,
+		"lease_duration": f.leaseDuration,
+		"renewable":      f.renewable,
+	}
+}
+
+func (f *fakeVault) renewalCount() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.renewals
+}
+
+func (f *fakeVault) revokedTokens() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]string(nil), f.revoked...)
+}
+
+func (f *fakeVault) loginCount() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.logins
+}
+
+func (f *fakeVault) client(t *testing.T) *vaultapi.Client {
+	config := vaultapi.DefaultConfig()
+	config.Address = f.URL
+	config.MaxRetries = 0
+	client, err := vaultapi.NewClient(config)
+	require.NoError(t, err)
+	client.ClearToken()
+	return client
+}
+
+// writeCertificate writes a self-signed certificate with the given common name and its private key to the given files.
+func writeCertificate(t *testing.T, commonName, certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes}), 0600))
+}
+
+func checkAppRoleLogin(secretID string) func(body map[string]interface{}) error {
+	return func(body map[string]interface{}) error {
+		if body["role_id"] != "role" || body["secret_id"] != secretID {
+			return fmt.Errorf("invalid role ID or secret ID")
+		}
+		return nil
+	}
+}
+
+func TestNewAuthMethod(t *testing.T) {
+	t.Run("token", func(t *testing.T) {
+		method, err := newAuthMethod(AuthConfig{})
+		assert.NoError(t, err)
+		assert.Nil(t, method)
+	})
+	t.Run("AppRole with default mount path", func(t *testing.T) {
+		method, err := newAuthMethod(AuthConfig{Method: AuthMethodAppRole, AppRole: AppRoleConfig{RoleID: "role", SecretID: "secret"}})
+		assert.NoError(t, err)
+		assert.Equal(t, "approle", method.(appRoleAuth).mountPath)
+	})
+	t.Run("AppRole with custom mount path", func(t *testing.T) {
+		method, err := newAuthMethod(AuthConfig{Method: AuthMethodAppRole, MountPath: "/nuts-approle/", AppRole: AppRoleConfig{RoleID: "role", SecretID: "secret"}})
+		assert.NoError(t, err)
+		assert.Equal(t, "nuts-approle", method.(appRoleAuth).mountPath)
+	})
+	t.Run("error - AppRole without role ID", func(t *testing.T) {
+		_, err := newAuthMethod(AuthConfig{Method: AuthMethodAppRole, AppRole: AppRoleConfig{SecretID: "secret"}})
+		assert.EqualError(t, err, "AppRole auth method requires a role ID")
+	})
+	t.Run("error - AppRole without secret ID", func(t *testing.T) {
+		_, err := newAuthMethod(AuthConfig{Method: AuthMethodAppRole, AppRole: AppRoleConfig{RoleID: "role"}})
+		assert.EqualError(t, err, "AppRole auth method requires a secret ID or secret ID file")
+	})
+	t.Run("Kubernetes with defaults", func(t *testing.T) {
+		method, err := newAuthMethod(AuthConfig{Method: AuthMethodKubernetes, Kubernetes: KubernetesConfig{Role: "nuts"}})
+		assert.NoError(t, err)
+		assert.Equal(t, kubernetesAuth{mountPath: "kubernetes", role: "nuts", tokenFile: defaultServiceAccountTokenFile}, method)
+	})
+	t.Run("error - Kubernetes without role", func(t *testing.T) {
+		_, err := newAuthMethod(AuthConfig{Method: AuthMethodKubernetes})
+		assert.EqualError(t, err, "Kubernetes auth method requires a role")
+	})
+	t.Run("JWT with default mount path", func(t *testing.T) {
+		method, err := newAuthMethod(AuthConfig{Method: AuthMethodJWT, JWT: JWTConfig{TokenFile: "token"}})
+		assert.NoError(t, err)
+		assert.Equal(t, jwtAuth{mountPath: "jwt", config: JWTConfig{TokenFile: "token"}}, method)
+	})
+	t.Run("error - JWT without token file", func(t *testing.T) {
+		_, err := newAuthMethod(AuthConfig{Method: AuthMethodJWT, JWT: JWTConfig{Role: "nuts"}})
+		assert.EqualError(t, err, "JWT auth method requires a token file")
+	})
+	t.Run("cert", func(t *testing.T) {
+		certFile, keyFile := filepath.Join(t.TempDir(), "cert.pem"), filepath.Join(t.TempDir(), "key.pem")
+		writeCertificate(t, "proxy", certFile, keyFile)
+		method, err := newAuthMethod(AuthConfig{Method: AuthMethodCert, Cert: CertConfig{Role: "nuts", CertFile: certFile, KeyFile: keyFile}})
+		require.NoError(t, err)
+		assert.Equal(t, "cert", method.(certAuth).mountPath)
+		assert.Equal(t, []string{certFile, keyFile}, method.(certAuth).credentialFiles())
+	})
+	t.Run("error - cert without key file", func(t *testing.T) {
+		_, err := newAuthMethod(AuthConfig{Method: AuthMethodCert, Cert: CertConfig{CertFile: "cert.pem"}})
+		assert.EqualError(t, err, "cert auth method requires a certificate and key file")
+	})
+	t.Run("error - cert with invalid certificate", func(t *testing.T) {
+		_, err := newAuthMethod(AuthConfig{Method: AuthMethodCert, Cert: CertConfig{CertFile: "cert.pem", KeyFile: "key.pem"}})
+		assert.ErrorContains(t, err, "unable to load client certificate")
+	})
+	t.Run("error - unsupported method", func(t *testing.T) {
+		_, err := newAuthMethod(AuthConfig{Method: "userpass"})
+		assert.EqualError(t, err, "unsupported auth method: userpass")
+	})
+}
+
+func TestAppRoleAuth(t *testing.T) {
+	t.Run("ok - secret ID", func(t *testing.T) {
+		server := newFakeVault(t, "/v1/auth/approle/login", checkAppRoleLogin("secret"))
+		client := server.client(t)
+		auth := authenticator{client: client, method: appRoleAuth{mountPath: "approle", config: AppRoleConfig{RoleID: "role", SecretID: "secret"}}}
+
+		secret, err := auth.login(context.Background())
+
+		require.NoError(t, err)
+		assert.Equal(t, "token-1", client.Token())
+		assert.Equal(t, time.Hour, tokenTTL(secret))
+	})
+	t.Run("ok - secret ID file is read on every login", func(t *testing.T) {
+		secretIDFile := filepath.Join(t.TempDir(), "secret-id")
+		require.NoError(t, os.WriteFile(secretIDFile, []byte("secret\n"), 0600))
+		server := newFakeVault(t, "/v1/auth/approle/login", checkAppRoleLogin("rotated"))
+		client := server.client(t)
+		auth := authenticator{client: client, method: appRoleAuth{mountPath: "approle", config: AppRoleConfig{RoleID: "role", SecretIDFile: secretIDFile}}}
+
+		_, err := auth.login(context.Background())
+		assert.Error(t, err)
+
+		require.NoError(t, os.WriteFile(secretIDFile, []byte("rotated\n"), 0600))
+		_, err = auth.login(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, "token-1", client.Token())
+	})
+	t.Run("error - secret ID file does not exist", func(t *testing.T) {
+		server := newFakeVault(t, "/v1/auth/approle/login", checkAppRoleLogin("secret"))
+		auth := authenticator{client: server.client(t), method: appRoleAuth{mountPath: "approle", config: AppRoleConfig{RoleID: "role", SecretIDFile: "does-not-exist"}}}
+
+		_, err := auth.login(context.Background())
+		assert.ErrorContains(t, err, "unable to read AppRole secret ID")
+	})
+	t.Run("error - invalid secret ID", func(t *testing.T) {
+		server := newFakeVault(t, "/v1/auth/approle/login", checkAppRoleLogin("secret"))
+		auth := authenticator{client: server.client(t), method: appRoleAuth{mountPath: "approle", config: AppRoleConfig{RoleID: "role", SecretID: "wrong"}}}
+
+		_, err := auth.login(context.Background())
+		assert.ErrorContains(t, err, "invalid role ID or secret ID")
+	})
+}
+
+func TestKubernetesAuth(t *testing.T) {
+	checkLogin := func(body map[string]interface{}) error {
+		if body["role"] != "nuts" || body["jwt"] != "rotated-jwt" {
+			return fmt.Errorf("invalid role or JWT")
+		}
+		return nil
+	}
+
+	t.Run("ok - token is read on every login", func(t *testing.T) {
+		tokenFile := filepath.Join(t.TempDir(), "token")
+		require.NoError(t, os.WriteFile(tokenFile, []byte("jwt"), 0600))
+		server := newFakeVault(t, "/v1/auth/k8s/login", checkLogin)
+		client := server.client(t)
+		auth := authenticator{client: client, method: kubernetesAuth{mountPath: "k8s", role: "nuts", tokenFile: tokenFile}}
+
+		_, err := auth.login(context.Background())
+		assert.ErrorContains(t, err, "invalid role or JWT")
+
+		require.NoError(t, os.WriteFile(tokenFile, []byte("rotated-jwt\n"), 0600))
+		_, err = auth.login(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, "token-1", client.Token())
+	})
+	t.Run("error - token file does not exist", func(t *testing.T) {
+		server := newFakeVault(t, "/v1/auth/kubernetes/login", checkLogin)
+		auth := authenticator{client: server.client(t), method: kubernetesAuth{mountPath: "kubernetes", role: "nuts", tokenFile: "does-not-exist"}}
+
+		_, err := auth.login(context.Background())
+		assert.ErrorContains(t, err, "unable to read Kubernetes service account token")
+	})
+}
+
+func TestJWTAuth(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "jwt")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("workload-jwt\n"), 0600))
+
+	t.Run("ok - with role", func(t *testing.T) {
+		server := newFakeVault(t, "/v1/auth/jwt/login", func(body map[string]interface{}) error {
+			if body["role"] != "nuts" || body["jwt"] != "workload-jwt" {
+				return fmt.Errorf("invalid role or JWT")
+			}
+			return nil
+		})
+		client := server.client(t)
+		auth := authenticator{client: client, method: jwtAuth{mountPath: "jwt", config: JWTConfig{Role: "nuts", TokenFile: tokenFile}}}
+
+		_, err := auth.login(context.Background())
+
+		assert.NoError(t, err)
+		assert.Equal(t, "token-1", client.Token())
+	})
+	t.Run("ok - default role", func(t *testing.T) {
+		server := newFakeVault(t, "/v1/auth/jwt/login", func(body map[string]interface{}) error {
+			if _, ok := body["role"]; ok {
+				return fmt.Errorf("unexpected role")
+			}
+			return nil
+		})
+		auth := authenticator{client: server.client(t), method: jwtAuth{mountPath: "jwt", config: JWTConfig{TokenFile: tokenFile}}}
+
+		_, err := auth.login(context.Background())
+
+		assert.NoError(t, err)
+	})
+	t.Run("error - token file does not exist", func(t *testing.T) {
+		server := newFakeVault(t, "/v1/auth/jwt/login", func(map[string]interface{}) error { return nil })
+		auth := authenticator{client: server.client(t), method: jwtAuth{mountPath: "jwt", config: JWTConfig{TokenFile: "does-not-exist"}}}
+
+		_, err := auth.login(context.Background())
+
+		assert.ErrorContains(t, err, "unable to read JWT")
+	})
+}
+
+func TestCertAuth(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCertificate(t, "proxy-1", certFile, keyFile)
+	server := &fakeVault{loginPath: "/v1/auth/cert/login", leaseDuration: 3600, checkLogin: func(body map[string]interface{}) error {
+		if body["name"] != "nuts" {
+			return fmt.Errorf("invalid role")
+		}
+		return nil
+	}}
+	server.Server = httptest.NewUnstartedServer(http.HandlerFunc(server.handle))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	t.Setenv("VAULT_ADDR", server.URL)
+	t.Setenv("VAULT_SKIP_VERIFY", "true")
+
+	method, err := newAuthMethod(AuthConfig{Method: AuthMethodCert, Cert: CertConfig{Role: "nuts", CertFile: certFile, KeyFile: keyFile}})
+	require.NoError(t, err)
+	client, err := configureVaultClient(method)
+	require.NoError(t, err)
+	auth := authenticator{client: client, method: method}
+
+	t.Run("ok", func(t *testing.T) {
+		_, err := auth.login(context.Background())
+
+		require.NoError(t, err)
+		assert.Equal(t, "token-1", client.Token())
+		assert.Equal(t, "proxy-1", server.clientCertificate)
+	})
+	t.Run("ok - rotated certificate is used for the next login", func(t *testing.T) {
+		writeCertificate(t, "proxy-2", certFile, keyFile)
+		// make sure the change is detected, regardless of the file system's timestamp resolution
+		require.NoError(t, os.Chtimes(certFile, time.Now(), time.Now().Add(time.Minute)))
+
+		_, err := auth.login(context.Background())
+
+		require.NoError(t, err)
+		assert.Equal(t, "proxy-2", server.clientCertificate)
+	})
+	t.Run("ok - invalid certificate on disk keeps the previous certificate", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(keyFile, []byte("invalid"), 0600))
+
+		_, err := auth.login(context.Background())
+
+		require.NoError(t, err)
+		assert.Equal(t, "proxy-2", server.clientCertificate)
+	})
+}
+
+func TestAuthenticator_lookupToken(t *testing.T) {
+	t.Run("ok", func(t *testing.T) {
+		server := newFakeVault(t, "", nil)
+		server.renewable = true
+		client := server.client(t)
+		client.SetToken("static-token")
+
+		secret, err := authenticator{client: client}.lookupToken()
+
+		require.NoError(t, err)
+		assert.Equal(t, "static-token", secret.Auth.ClientToken)
+		assert.True(t, secret.Auth.Renewable)
+		assert.Equal(t, time.Hour, tokenTTL(secret))
+	})
+	t.Run("error - lookup fails", func(t *testing.T) {
+		server := newFakeVault(t, "", nil)
+		server.Close()
+
+		_, err := authenticator{client: server.client(t)}.lookupToken()
+
+		assert.ErrorContains(t, err, "unable to look up Vault token")
+	})
+}
+
+func TestAuthenticator_run(t *testing.T) {
+	t.Run("logs in again before the token expires", func(t *testing.T) {
+		server := newFakeVault(t, "/v1/auth/approle/login", checkAppRoleLogin("secret"))
+		server.leaseDuration = 1
+		client := server.client(t)
+		auth := authenticator{client: client, method: appRoleAuth{mountPath: "approle", config: AppRoleConfig{RoleID: "role", SecretID: "secret"}}}
+		secret, err := auth.login(context.Background())
+		require.NoError(t, err)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		go auth.run(ctx, secret)
+
+		assert.Eventually(t, func() bool {
+			return server.loginCount() >= 2
+		}, 5*time.Second, 50*time.Millisecond)
+		assert.NotEqual(t, "token-1", client.Token())
+	})
+	t.Run("logs in again when the credentials change on disk", func(t *testing.T) {
+		interval := fileWatchInterval
+		fileWatchInterval = 10 * time.Millisecond
+		defer func() { fileWatchInterval = interval }()
+		tokenFile := filepath.Join(t.TempDir(), "jwt")
+		require.NoError(t, os.WriteFile(tokenFile, []byte("jwt"), 0600))
+		server := newFakeVault(t, "/v1/auth/jwt/login", func(map[string]interface{}) error { return nil })
+		auth := authenticator{client: server.client(t), method: jwtAuth{mountPath: "jwt", config: JWTConfig{TokenFile: tokenFile}}}
+		secret, err := auth.login(context.Background())
+		require.NoError(t, err)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go auth.run(ctx, secret)
+		time.Sleep(50 * time.Millisecond)
+		assert.Equal(t, 1, server.loginCount(), "should not log in again while the file is unchanged")
+
+		require.NoError(t, os.WriteFile(tokenFile, []byte("rotated-jwt"), 0600))
+
+		assert.Eventually(t, func() bool {
+			return server.loginCount() == 2
+		}, 5*time.Second, 10*time.Millisecond)
+		assert.Eventually(t, func() bool {
+			return slices.Equal([]string{"token-1"}, server.revokedTokens())
+		}, 5*time.Second, 10*time.Millisecond, "previous token should be revoked")
+	})
+	t.Run("keeps the new token if the previous one can't be revoked", func(t *testing.T) {
+		server := newFakeVault(t, "/v1/auth/approle/login", checkAppRoleLogin("secret"))
+		server.leaseDuration = 1
+		server.denyRevocation = true
+		client := server.client(t)
+		auth := authenticator{client: client, method: appRoleAuth{mountPath: "approle", config: AppRoleConfig{RoleID: "role", SecretID: "secret"}}}
+		secret, err := auth.login(context.Background())
+		require.NoError(t, err)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		go auth.run(ctx, secret)
+
+		assert.Eventually(t, func() bool {
+			return server.loginCount() >= 2
+		}, 5*time.Second, 50*time.Millisecond)
+		assert.Empty(t, server.revokedTokens())
+		assert.NotEqual(t, "token-1", client.Token())
+	})
+	t.Run("renews a renewable token", func(t *testing.T) {
+		server := newFakeVault(t, "/v1/auth/approle/login", checkAppRoleLogin("secret"))
+		server.renewable = true
+		server.leaseDuration = 2
+		client := server.client(t)
+		auth := authenticator{client: client, method: appRoleAuth{mountPath: "approle", config: AppRoleConfig{RoleID: "role", SecretID: "secret"}}}
+		secret, err := auth.login(context.Background())
+		require.NoError(t, err)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		go auth.run(ctx, secret)
+
+		assert.Eventually(t, func() bool {
+			return server.renewalCount() >= 2
+		}, 5*time.Second, 10*time.Millisecond)
+		assert.Equal(t, 1, server.loginCount(), "renewable token should not be replaced")
+		assert.Equal(t, "token-1", client.Token())
+	})
+	t.Run("logs in again if the token can't be renewed", func(t *testing.T) {
+		server := newFakeVault(t, "/v1/auth/approle/login", checkAppRoleLogin("secret"))
+		server.renewable = true
+		server.denyRenewal = true
+		server.leaseDuration = 2
+		client := server.client(t)
+		auth := authenticator{client: client, method: appRoleAuth{mountPath: "approle", config: AppRoleConfig{RoleID: "role", SecretID: "secret"}}}
+		secret, err := auth.login(context.Background())
+		require.NoError(t, err)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		go auth.run(ctx, secret)
+
+		assert.Eventually(t, func() bool {
+			return server.loginCount() >= 2
+		}, 5*time.Second, 10*time.Millisecond)
+		assert.NotEqual(t, "token-1", client.Token())
+	})
+	t.Run("renews a static token", func(t *testing.T) {
+		server := newFakeVault(t, "", nil)
+		server.renewable = true
+		server.leaseDuration = 2
+		client := server.client(t)
+		client.SetToken("static-token")
+		auth := authenticator{client: client}
+		secret, err := auth.lookupToken()
+		require.NoError(t, err)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		go auth.run(ctx, secret)
+
+		assert.Eventually(t, func() bool {
+			return server.renewalCount() >= 1
+		}, 5*time.Second, 10*time.Millisecond)
+		assert.Equal(t, "static-token", client.Token())
+	})
+	t.Run("stops when a static token can't be renewed", func(t *testing.T) {
+		done := make(chan struct{})
+		go func() {
+			authenticator{}.run(context.Background(), &vaultapi.Secret{Auth: &vaultapi.SecretAuth{LeaseDuration: 1}})
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected run to return")
+		}
+	})
+	t.Run("does not log in again if the token does not expire", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			authenticator{}.run(ctx, &vaultapi.Secret{Auth: &vaultapi.SecretAuth{LeaseDuration: 0}})
+			close(done)
+		}()
+		cancel()
+		<-done
+	})
+}
@@ -0,0 +1,203 @@
+/*
+ * Copyright (C) 2023 Nuts community
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package vault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	"github.com/sirupsen/logrus"
+)
+
+// BreakerConfig configures the circuit breaker, which fails requests fast while Vault is failing.
+type BreakerConfig struct {
+	// FailureThreshold is the number of consecutive failed requests after which the circuit breaker opens.
+	// A value of 0 disables the circuit breaker.
+	FailureThreshold int
+	// OpenTimeout is the time the circuit breaker stays open before letting a probe request through.
+	OpenTimeout time.Duration
+}
+
+// DefaultBreakerConfig returns the default circuit breaker configuration.
+func DefaultBreakerConfig() BreakerConfig {
+	return BreakerConfig{
+		FailureThreshold: 5,
+		OpenTimeout:      30 * time.Second,
+	}
+}
+
+func (c BreakerConfig) validate() error {
+	if c.FailureThreshold < 0 {
+		return errors.New("circuit breaker failure threshold can't be negative")
+	}
+	if c.FailureThreshold > 0 && c.OpenTimeout <= 0 {
+		return errors.New("circuit breaker open timeout must be positive")
+	}
+	return nil
+}
+
+// circuitBreaker tracks the failures of the requests to Vault. After FailureThreshold consecutive failures it opens,
+// failing requests without sending them to Vault. After OpenTimeout it becomes half-open and lets a single probe
+// request through: if it succeeds the circuit breaker closes, otherwise it opens again.
+type circuitBreaker struct {
+	config BreakerConfig
+	// now returns the current time, it can be replaced in tests.
+	now func() time.Time
+
+	mux      sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	// probing indicates a probe request is in progress in half-open state.
+	probing bool
+}
+
+func newCircuitBreaker(config BreakerConfig) *circuitBreaker {
+	return &circuitBreaker{config: config, now: time.Now, state: CircuitBreakerClosed}
+}
+
+// State returns the current state of the circuit breaker (one of the CircuitBreaker constants).
+func (b *circuitBreaker) State() string {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.state
+}
+
+// allow returns ErrCircuitOpen if the request may not be sent to Vault.
+// Otherwise, the caller must report the result of the request using done.
+func (b *circuitBreaker) allow() error {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	switch b.state {
+	case CircuitBreakerOpen:
+		if b.now().Sub(b.openedAt) < b.config.OpenTimeout {
+			return ErrCircuitOpen
+		}
+		b.setState(CircuitBreakerHalfOpen)
+		b.probing = true
+	case CircuitBreakerHalfOpen:
+		if b.probing {
+			return ErrCircuitOpen
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// done records the result of a request which was allowed.
+func (b *circuitBreaker) done(err error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if errors.Is(err, context.Canceled) || errors.Is(err, ErrBusy) {
+		// the caller gave up or the limiter rejected the request before sending it, which tells nothing about Vault
+		if b.state == CircuitBreakerHalfOpen {
+			b.probing = false
+		}
+		return
+	}
+	failed := isBreakerFailure(err)
+	switch b.state {
+	case CircuitBreakerClosed:
+		if !failed {
+			b.failures = 0
+			return
+		}
+		b.failures++
+		if b.failures >= b.config.FailureThreshold {
+			logrus.WithError(err).Warnf("Vault request failed %d times in a row, opening circuit breaker for %s", b.failures, b.config.OpenTimeout)
+			b.open()
+		}
+	case CircuitBreakerHalfOpen:
+		b.probing = false
+		if failed {
+			logrus.WithError(err).Warnf("Vault probe request failed, opening circuit breaker for %s", b.config.OpenTimeout)
+			b.open()
+		} else {
+			b.failures = 0
+			b.setState(CircuitBreakerClosed)
+		}
+	}
+	// in open state, the result is of a request allowed before the circuit breaker opened
+}
+
+func (b *circuitBreaker) open() {
+	b.openedAt = b.now()
+	b.setState(CircuitBreakerOpen)
+}
+
+func (b *circuitBreaker) setState(state string) {
+	if b.state != state {
+		logrus.Infof("Vault circuit breaker state changed from %s to %s", b.state, state)
+	}
+	b.state = state
+}
+
+// isBreakerFailure returns whether the (classified) error indicates Vault is failing. Rate limiting doesn't count,
+// since Vault is responding, and neither do error responses caused by the request (e.g. permission denied).
+func isBreakerFailure(err error) bool {
+	return err != nil && isTransient(err) && !errors.Is(err, ErrRateLimited)
+}
+
+// breakerClient is a vaultClient which only sends requests to the wrapped client when the circuit breaker allows it.
+type breakerClient struct {
+	client  vaultClient
+	breaker *circuitBreaker
+}
+
+func (c breakerClient) ReadWithContext(ctx context.Context, path string) (*vaultapi.Secret, error) {
+	return c.do(func() (*vaultapi.Secret, error) {
+		return c.client.ReadWithContext(ctx, path)
+	})
+}
+
+func (c breakerClient) WriteWithContext(ctx context.Context, path string, data map[string]interface{}) (*vaultapi.Secret, error) {
+	return c.do(func() (*vaultapi.Secret, error) {
+		return c.client.WriteWithContext(ctx, path, data)
+	})
+}
+
+func (c breakerClient) ListWithContext(ctx context.Context, path string) (*vaultapi.Secret, error) {
+	return c.do(func() (*vaultapi.Secret, error) {
+		return c.client.ListWithContext(ctx, path)
+	})
+}
+
+func (c breakerClient) ReadWithDataWithContext(ctx context.Context, path string, data map[string][]string) (*vaultapi.Secret, error) {
+	return c.do(func() (*vaultapi.Secret, error) {
+		return c.client.ReadWithDataWithContext(ctx, path, data)
+	})
+}
+
+func (c breakerClient) DeleteWithContext(ctx context.Context, path string) (*vaultapi.Secret, error) {
+	return c.do(func() (*vaultapi.Secret, error) {
+		return c.client.DeleteWithContext(ctx, path)
+	})
+}
+
+func (c breakerClient) do(request func() (*vaultapi.Secret, error)) (*vaultapi.Secret, error) {
+	if err := c.breaker.allow(); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrUnavailable, err)
+	}
+	secret, err := request()
+	c.breaker.done(err)
+	return secret, err
+}
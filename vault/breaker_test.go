@@ -0,0 +1,180 @@
+/*
+ * Copyright (C) 2023 Nuts community
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package vault
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestBreakerClient returns a breakerClient with a threshold of 3 failures, of which the clock can be advanced.
+func newTestBreakerClient(client vaultClient) (breakerClient, *time.Time) {
+	now := time.Now()
+	breaker := newCircuitBreaker(BreakerConfig{FailureThreshold: 3, OpenTimeout: time.Minute})
+	breaker.now = func() time.Time { return now }
+	return breakerClient{client: client, breaker: breaker}, &now
+}
+
+func TestBreakerClient(t *testing.T) {
+	ctx := context.Background()
+	store := map[string]map[string]interface{}{"kv/key": {"key": "value"}}
+
+	t.Run("opens after consecutive failures and fails fast", func(t *testing.T) {
+		faulty := &faultyVaultClient{client: mockVaultClient{store: store}, faults: []error{serviceUnavailable, serviceUnavailable, serviceUnavailable}}
+		client, _ := newTestBreakerClient(faulty)
+
+		for i := 0; i < 3; i++ {
+			_, err := client.ReadWithContext(ctx, "kv/key")
+			assert.ErrorIs(t, err, serviceUnavailable)
+		}
+		assert.Equal(t, CircuitBreakerOpen, client.breaker.State())
+
+		_, err := client.ReadWithContext(ctx, "kv/key")
+		assert.ErrorIs(t, err, ErrCircuitOpen)
+		assert.ErrorIs(t, err, ErrUnavailable)
+		assert.Equal(t, 3, faulty.calls, "request should not be sent to Vault")
+	})
+	t.Run("success resets the failure count", func(t *testing.T) {
+		faulty := &faultyVaultClient{client: mockVaultClient{store: store}, faults: []error{serviceUnavailable, serviceUnavailable, nil, serviceUnavailable, serviceUnavailable}}
+		client, _ := newTestBreakerClient(faulty)
+
+		for i := 0; i < 5; i++ {
+			_, _ = client.ReadWithContext(ctx, "kv/key")
+		}
+
+		assert.Equal(t, CircuitBreakerClosed, client.breaker.State())
+	})
+	t.Run("other errors do not count as failures", func(t *testing.T) {
+		faulty := &faultyVaultClient{client: mockVaultClient{store: store}, faults: []error{permissionDenied, rateLimited, permissionDenied, rateLimited}}
+		client, _ := newTestBreakerClient(faulty)
+
+		for i := 0; i < 4; i++ {
+			_, _ = client.ReadWithContext(ctx, "kv/key")
+		}
+
+		assert.Equal(t, CircuitBreakerClosed, client.breaker.State())
+	})
+	t.Run("closes when the probe succeeds", func(t *testing.T) {
+		faulty := &faultyVaultClient{client: mockVaultClient{store: store}, faults: []error{serviceUnavailable, serviceUnavailable, serviceUnavailable}}
+		client, now := newTestBreakerClient(faulty)
+		for i := 0; i < 3; i++ {
+			_, _ = client.ReadWithContext(ctx, "kv/key")
+		}
+
+		*now = now.Add(time.Minute)
+		result, err := client.ReadWithContext(ctx, "kv/key")
+
+		assert.NoError(t, err)
+		assert.Equal(t, "value", result.Data["key"])
+		assert.Equal(t, CircuitBreakerClosed, client.breaker.State())
+	})
+	t.Run("opens again when the probe fails", func(t *testing.T) {
+		faulty := &faultyVaultClient{client: mockVaultClient{store: store}, faults: []error{serviceUnavailable, serviceUnavailable, serviceUnavailable, connectionRefused}}
+		client, now := newTestBreakerClient(faulty)
+		for i := 0; i < 3; i++ {
+			_, _ = client.ReadWithContext(ctx, "kv/key")
+		}
+
+		*now = now.Add(time.Minute)
+		_, err := client.ReadWithContext(ctx, "kv/key")
+		assert.ErrorIs(t, err, connectionRefused)
+		assert.Equal(t, CircuitBreakerOpen, client.breaker.State())
+
+		*now = now.Add(30 * time.Second)
+		_, err = client.ReadWithContext(ctx, "kv/key")
+		assert.ErrorIs(t, err, ErrCircuitOpen)
+		assert.Equal(t, 4, faulty.calls)
+	})
+	t.Run("lets a single probe through in half-open state", func(t *testing.T) {
+		client, now := newTestBreakerClient(nil)
+		client.breaker.open()
+		*now = now.Add(time.Minute)
+		// the probe is sent to Vault, other requests fail fast while it is in progress
+		client.client = probingVaultClient(func() {
+			assert.Equal(t, CircuitBreakerHalfOpen, client.breaker.State())
+			_, err := client.ReadWithContext(ctx, "kv/key")
+			assert.ErrorIs(t, err, ErrCircuitOpen)
+		})
+
+		_, err := client.ReadWithContext(ctx, "kv/key")
+
+		assert.NoError(t, err)
+		assert.Equal(t, CircuitBreakerClosed, client.breaker.State())
+	})
+	t.Run("cancelled probe does not close the circuit breaker", func(t *testing.T) {
+		client, now := newTestBreakerClient(blockingVaultClient{})
+		client.breaker.open()
+		*now = now.Add(time.Minute)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := client.ReadWithContext(ctx, "kv/key")
+
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.Equal(t, CircuitBreakerHalfOpen, client.breaker.State())
+		assert.NoError(t, client.breaker.allow(), "next request should be allowed as probe")
+	})
+}
+
+// probingVaultClient calls the function while handling a read, which succeeds.
+type probingVaultClient func()
+
+func (p probingVaultClient) ReadWithContext(_ context.Context, _ string) (*vaultapi.Secret, error) {
+	p()
+	return &vaultapi.Secret{}, nil
+}
+
+func (p probingVaultClient) WriteWithContext(_ context.Context, _ string, _ map[string]interface{}) (*vaultapi.Secret, error) {
+	return nil, nil
+}
+
+func (p probingVaultClient) ListWithContext(_ context.Context, _ string) (*vaultapi.Secret, error) {
+	return nil, nil
+}
+
+func (p probingVaultClient) ReadWithDataWithContext(_ context.Context, _ string, _ map[string][]string) (*vaultapi.Secret, error) {
+	return nil, nil
+}
+
+func (p probingVaultClient) DeleteWithContext(_ context.Context, _ string) (*vaultapi.Secret, error) {
+	return nil, nil
+}
+
+func TestVaultKVStorage_Ping_circuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	breaker := newCircuitBreaker(BreakerConfig{FailureThreshold: 1, OpenTimeout: time.Minute})
+	breaker.open()
+	v := KVStorage{client: breakerClient{client: mockVaultClient{}, breaker: breaker}, sys: activeVault, breaker: breaker}
+
+	status, err := v.Ping(ctx)
+
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+	assert.Equal(t, CircuitBreakerOpen, status.CircuitBreaker)
+	assert.Equal(t, VaultStateActive, status.VaultState)
+}
+
+func TestBreakerConfig_validate(t *testing.T) {
+	assert.NoError(t, DefaultBreakerConfig().validate())
+	assert.NoError(t, BreakerConfig{}.validate(), "disabled")
+	assert.EqualError(t, BreakerConfig{FailureThreshold: -1}.validate(), "circuit breaker failure threshold can't be negative")
+	assert.EqualError(t, BreakerConfig{FailureThreshold: 1}.validate(), "circuit breaker open timeout must be positive")
+}
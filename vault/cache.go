@@ -0,0 +1,230 @@
+/*
+ * Copyright (C) 2023 Nuts community
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package vault
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// CacheConfig configures the in-memory cache of secrets.
+type CacheConfig struct {
+	// TTL is how long a secret is cached after it was read from Vault. A value of 0 disables the cache.
+	TTL time.Duration
+	// MaxEntries is the maximum number of cached secrets. When full, the oldest secret is evicted.
+	MaxEntries int
+	// StaleGracePeriod is how long after expiring a secret is still returned when Vault is unavailable or sealed.
+	// A value of 0 disables serving stale secrets.
+	StaleGracePeriod time.Duration
+}
+
+// Enabled returns whether the configuration enables the cache, which is also needed to serve stale secrets.
+func (c CacheConfig) Enabled() bool {
+	return c.TTL > 0 || c.StaleGracePeriod > 0
+}
+
+// DefaultCacheConfig returns the default cache configuration, which has the cache disabled.
+func DefaultCacheConfig() CacheConfig {
+	return CacheConfig{MaxEntries: 1000}
+}
+
+func (c CacheConfig) validate() error {
+	if c.TTL < 0 || c.StaleGracePeriod < 0 {
+		return errors.New("cache TTL and stale grace period can't be negative")
+	}
+	if c.Enabled() && c.MaxEntries <= 0 {
+		return errors.New("cache max entries must be positive")
+	}
+	return nil
+}
+
+// CacheStats contains the counters of a CachingStorage.
+type CacheStats struct {
+	// Hits is the number of secrets returned from the cache.
+	Hits uint64
+	// Misses is the number of secrets that had to be read from the backend.
+	Misses uint64
+	// Stale is the number of expired secrets returned because the backend was unavailable.
+	Stale uint64
+}
+
+// CachingStorage is a Storage which caches the secrets read from the wrapped Storage in memory.
+// Secrets stored or deleted through it are removed from the cache, changes made directly in Vault only become
+// visible when the cached secret expires. Cached secrets are zeroed when they expire or are evicted.
+// If a stale grace period is configured, expired secrets are kept for the grace period and returned together with
+// ErrStale when reading them from the wrapped Storage fails because Vault is unavailable or sealed.
+type CachingStorage struct {
+	Storage
+	config CacheConfig
+	// now returns the current time, it can be replaced in tests.
+	now func() time.Time
+
+	mux sync.Mutex
+	// entries indexes the elements of order by key.
+	entries map[string]*list.Element
+	// order contains the cacheEntry values from newest (front) to oldest (back).
+	order *list.List
+	// generation is incremented on every invalidation, to prevent caching secrets read before the invalidation.
+	generation uint64
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+	stale  atomic.Uint64
+}
+
+type cacheEntry struct {
+	key   string
+	value []byte
+	// cached is the time the value was read from the backend.
+	cached time.Time
+}
+
+// NewCachingStorage returns a CachingStorage caching the secrets of the given Storage.
+func NewCachingStorage(storage Storage, config CacheConfig) (*CachingStorage, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return &CachingStorage{
+		Storage: storage,
+		config:  config,
+		now:     time.Now,
+		entries: map[string]*list.Element{},
+		order:   list.New(),
+	}, nil
+}
+
+// GetSecret returns the secret from the cache, or reads it from the wrapped Storage if it isn't cached.
+// Secrets are cached by their normalized key, so all spellings of a key share the same cache entry.
+func (c *CachingStorage) GetSecret(ctx context.Context, key string) ([]byte, error) {
+	cacheKey := normalizeKey(key)
+	c.mux.Lock()
+	c.removeExpired()
+	var stale []byte
+	var cached time.Time
+	if element, ok := c.entries[cacheKey]; ok {
+		entry := element.Value.(*cacheEntry)
+		if c.now().Before(entry.cached.Add(c.config.TTL)) {
+			value := clone(entry.value)
+			c.mux.Unlock()
+			c.hits.Add(1)
+			return value, nil
+		}
+		// expired, but kept for the grace period
+		stale, cached = clone(entry.value), entry.cached
+	}
+	generation := c.generation
+	c.mux.Unlock()
+
+	c.misses.Add(1)
+	value, err := c.Storage.GetSecret(ctx, key)
+	if err != nil {
+		if stale != nil && (errors.Is(err, ErrUnavailable) || errors.Is(err, ErrSealed) || errors.Is(err, ErrTimeout)) {
+			c.stale.Add(1)
+			age := c.now().Sub(cached).Truncate(time.Second)
+			logrus.WithError(err).Warnf("Vault is unavailable, serving stale secret cached %s ago", age)
+			return stale, fmt.Errorf("%w (cached %s ago): %w", ErrStale, age, err)
+		}
+		clear(stale)
+		if errors.Is(err, ErrNotFound) {
+			// deleted in Vault, so it must not be served when Vault becomes unavailable
+			c.invalidate(key)
+		}
+		return nil, err
+	}
+	clear(stale)
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if generation == c.generation {
+		if element, ok := c.entries[cacheKey]; ok {
+			c.remove(element)
+		}
+		c.add(cacheKey, clone(value))
+	}
+	return value, nil
+}
+
+// StoreSecret stores the secret in the wrapped Storage and removes it from the cache.
+func (c *CachingStorage) StoreSecret(ctx context.Context, key string, value []byte) error {
+	defer c.invalidate(key)
+	return c.Storage.StoreSecret(ctx, key, value)
+}
+
+// DeleteSecret deletes the secret from the wrapped Storage and removes it from the cache.
+func (c *CachingStorage) DeleteSecret(ctx context.Context, key string) error {
+	defer c.invalidate(key)
+	return c.Storage.DeleteSecret(ctx, key)
+}
+
+// Stats returns the hit and miss counters of the cache.
+func (c *CachingStorage) Stats() CacheStats {
+	return CacheStats{Hits: c.hits.Load(), Misses: c.misses.Load(), Stale: c.stale.Load()}
+}
+
+// Len returns the number of cached secrets.
+func (c *CachingStorage) Len() int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.order.Len()
+}
+
+func (c *CachingStorage) invalidate(key string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.generation++
+	if element, ok := c.entries[normalizeKey(key)]; ok {
+		c.remove(element)
+	}
+}
+
+// add caches the value, evicting the oldest secret if the cache is full. The caller must hold the lock.
+func (c *CachingStorage) add(key string, value []byte) {
+	for c.order.Len() >= c.config.MaxEntries {
+		c.remove(c.order.Back())
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, value: value, cached: c.now()})
+}
+
+// removeExpired removes the secrets that expired and are past the stale grace period, which are the oldest ones.
+// The caller must hold the lock.
+func (c *CachingStorage) removeExpired() {
+	retention := c.config.TTL + c.config.StaleGracePeriod
+	now := c.now()
+	for element := c.order.Back(); element != nil && !now.Before(element.Value.(*cacheEntry).cached.Add(retention)); element = c.order.Back() {
+		c.remove(element)
+	}
+}
+
+// remove removes the element from the cache and zeroes its value. The caller must hold the lock.
+func (c *CachingStorage) remove(element *list.Element) {
+	entry := c.order.Remove(element).(*cacheEntry)
+	delete(c.entries, entry.key)
+	clear(entry.value)
+}
+
+// clone returns a copy of the value, so the cached value can be zeroed without affecting the caller and vice versa.
+func clone(value []byte) []byte {
+	return append([]byte(nil), value...)
+}
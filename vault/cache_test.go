@@ -0,0 +1,265 @@
+/*
+ * Copyright (C) 2023 Nuts community
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package vault
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestCache returns a CachingStorage in front of a KVStorage, of which the Vault requests are counted, and the clock can be advanced.
+func newTestCache(t *testing.T, config CacheConfig) (*CachingStorage, *faultyVaultClient, *time.Time) {
+	client := &faultyVaultClient{client: mockVaultClient{store: map[string]map[string]interface{}{}}}
+	cache, err := NewCachingStorage(KVStorage{client: client, pathPrefix: prefix}, config)
+	require.NoError(t, err)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+	return cache, client, &now
+}
+
+func TestCachingStorage(t *testing.T) {
+	ctx := context.Background()
+	config := CacheConfig{TTL: time.Minute, MaxEntries: 2}
+
+	t.Run("caches secrets", func(t *testing.T) {
+		cache, client, _ := newTestCache(t, config)
+		require.NoError(t, cache.StoreSecret(ctx, kid, secret))
+		calls := client.calls
+
+		for i := 0; i < 3; i++ {
+			result, err := cache.GetSecret(ctx, kid)
+			require.NoError(t, err)
+			assert.Equal(t, secret, result)
+		}
+
+		assert.Equal(t, calls+1, client.calls)
+		assert.Equal(t, CacheStats{Hits: 2, Misses: 1}, cache.Stats())
+	})
+	t.Run("secrets expire", func(t *testing.T) {
+		cache, client, now := newTestCache(t, config)
+		require.NoError(t, cache.StoreSecret(ctx, kid, secret))
+		_, _ = cache.GetSecret(ctx, kid)
+		cached := cache.entries[kid].Value.(*cacheEntry).value
+		calls := client.calls
+
+		*now = now.Add(time.Minute)
+		_, err := cache.GetSecret(ctx, kid)
+
+		require.NoError(t, err)
+		assert.Equal(t, calls+1, client.calls)
+		assert.Equal(t, make([]byte, len(secret)), cached, "expired value should be zeroed")
+		assert.Equal(t, CacheStats{Misses: 2}, cache.Stats())
+	})
+	t.Run("evicts the oldest secret when full", func(t *testing.T) {
+		cache, _, now := newTestCache(t, config)
+		for i := 0; i < 3; i++ {
+			key := fmt.Sprintf("key-%d", i)
+			require.NoError(t, cache.StoreSecret(ctx, key, secret))
+			_, _ = cache.GetSecret(ctx, key)
+			if i == 0 {
+				defer func(cached []byte) {
+					assert.Equal(t, make([]byte, len(secret)), cached, "evicted value should be zeroed")
+				}(cache.entries[key].Value.(*cacheEntry).value)
+			}
+			*now = now.Add(time.Second)
+		}
+
+		assert.Equal(t, 2, cache.Len())
+		assert.NotContains(t, cache.entries, "key-0")
+	})
+	t.Run("deleting a secret invalidates it", func(t *testing.T) {
+		cache, _, _ := newTestCache(t, config)
+		require.NoError(t, cache.StoreSecret(ctx, kid, secret))
+		_, _ = cache.GetSecret(ctx, kid)
+		cached := cache.entries[kid].Value.(*cacheEntry).value
+
+		require.NoError(t, cache.DeleteSecret(ctx, kid))
+		_, err := cache.GetSecret(ctx, kid)
+
+		assert.ErrorIs(t, err, ErrNotFound)
+		assert.Equal(t, make([]byte, len(secret)), cached, "invalidated value should be zeroed")
+	})
+	t.Run("deleting a secret invalidates other spellings of its key", func(t *testing.T) {
+		cache, _, _ := newTestCache(t, config)
+		require.NoError(t, cache.StoreSecret(ctx, kid, secret))
+		_, _ = cache.GetSecret(ctx, "a/"+kid)
+
+		require.NoError(t, cache.DeleteSecret(ctx, kid))
+		_, err := cache.GetSecret(ctx, "a/"+kid)
+
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+	t.Run("spellings of a key share the cached secret", func(t *testing.T) {
+		cache, client, _ := newTestCache(t, config)
+		require.NoError(t, cache.StoreSecret(ctx, "a/"+kid, secret))
+		calls := client.calls
+
+		for _, key := range []string{kid, "a/" + kid, "/b/" + kid} {
+			result, err := cache.GetSecret(ctx, key)
+			require.NoError(t, err)
+			assert.Equal(t, secret, result)
+		}
+
+		assert.Equal(t, calls+1, client.calls)
+		assert.Equal(t, 1, cache.Len())
+	})
+	t.Run("storing a secret invalidates it", func(t *testing.T) {
+		cache, _, _ := newTestCache(t, config)
+		require.NoError(t, cache.StoreSecret(ctx, kid, secret))
+		_, _ = cache.GetSecret(ctx, kid)
+
+		assert.ErrorIs(t, cache.StoreSecret(ctx, kid, secret), ErrKeyAlreadyExists)
+
+		assert.Equal(t, 0, cache.Len())
+	})
+	t.Run("not found is not cached", func(t *testing.T) {
+		cache, client, _ := newTestCache(t, config)
+
+		_, err := cache.GetSecret(ctx, kid)
+		assert.ErrorIs(t, err, ErrNotFound)
+		_, err = cache.GetSecret(ctx, kid)
+		assert.ErrorIs(t, err, ErrNotFound)
+
+		assert.Equal(t, 2, client.calls)
+		assert.Equal(t, 0, cache.Len())
+	})
+	t.Run("returns copies of the cached value", func(t *testing.T) {
+		cache, _, _ := newTestCache(t, config)
+		require.NoError(t, cache.StoreSecret(ctx, kid, secret))
+		result, _ := cache.GetSecret(ctx, kid)
+		clear(result)
+
+		result, err := cache.GetSecret(ctx, kid)
+
+		require.NoError(t, err)
+		assert.Equal(t, secret, result)
+	})
+	t.Run("secret read before an invalidation is not cached", func(t *testing.T) {
+		cache, _, _ := newTestCache(t, config)
+		require.NoError(t, cache.StoreSecret(ctx, kid, secret))
+		// the secret is deleted while it is being read
+		cache.Storage = invalidatingStorage{Storage: cache.Storage, invalidate: func() { cache.invalidate(kid) }}
+
+		_, err := cache.GetSecret(ctx, kid)
+
+		require.NoError(t, err)
+		assert.Equal(t, 0, cache.Len())
+	})
+}
+
+func TestCachingStorage_stale(t *testing.T) {
+	ctx := context.Background()
+	config := CacheConfig{TTL: time.Minute, MaxEntries: 10, StaleGracePeriod: time.Hour}
+	// newStaleCache returns a cache with an expired secret, which fails to be read from Vault with the given error.
+	newStaleCache := func(t *testing.T, fault error) (*CachingStorage, *faultyVaultClient, *time.Time) {
+		cache, client, now := newTestCache(t, config)
+		require.NoError(t, cache.StoreSecret(ctx, kid, secret))
+		_, _ = cache.GetSecret(ctx, kid)
+		*now = now.Add(30 * time.Minute)
+		client.faults = []error{fault}
+		return cache, client, now
+	}
+
+	faults := map[string]error{
+		"unavailable": serviceUnavailable,
+		"unreachable": connectionRefused,
+		"sealed":      &vaultapi.ResponseError{StatusCode: 503, Errors: []string{"Vault is sealed"}},
+	}
+	for name, fault := range faults {
+		t.Run("serves stale secret when Vault is "+name, func(t *testing.T) {
+			cache, _, _ := newStaleCache(t, fault)
+
+			result, err := cache.GetSecret(ctx, kid)
+
+			assert.ErrorIs(t, err, ErrStale)
+			assert.ErrorIs(t, err, fault)
+			assert.ErrorContains(t, err, "serving stale secret (cached 30m0s ago)")
+			assert.Equal(t, secret, result)
+			assert.Equal(t, uint64(1), cache.Stats().Stale)
+		})
+	}
+	t.Run("refreshes expired secret when Vault is available", func(t *testing.T) {
+		cache, _, _ := newStaleCache(t, nil)
+
+		result, err := cache.GetSecret(ctx, kid)
+
+		assert.NoError(t, err)
+		assert.Equal(t, secret, result)
+		assert.Equal(t, CacheStats{Hits: 0, Misses: 2}, cache.Stats())
+	})
+	t.Run("does not serve stale secret on other errors", func(t *testing.T) {
+		cache, _, _ := newStaleCache(t, permissionDenied)
+
+		result, err := cache.GetSecret(ctx, kid)
+
+		assert.ErrorIs(t, err, ErrPermissionDenied)
+		assert.NotErrorIs(t, err, ErrStale)
+		assert.Nil(t, result)
+	})
+	t.Run("does not serve stale secret after the grace period", func(t *testing.T) {
+		cache, _, now := newStaleCache(t, serviceUnavailable)
+		*now = now.Add(time.Hour)
+
+		result, err := cache.GetSecret(ctx, kid)
+
+		assert.ErrorIs(t, err, ErrUnavailable)
+		assert.NotErrorIs(t, err, ErrStale)
+		assert.Nil(t, result)
+		assert.Equal(t, 0, cache.Len())
+	})
+	t.Run("does not serve deleted secret", func(t *testing.T) {
+		cache, client, _ := newStaleCache(t, nil)
+		_, err := client.DeleteWithContext(ctx, storagePath(prefix, kid))
+		require.NoError(t, err)
+
+		_, err = cache.GetSecret(ctx, kid)
+
+		assert.ErrorIs(t, err, ErrNotFound)
+		assert.Equal(t, 0, cache.Len())
+	})
+	t.Run("writes fail closed", func(t *testing.T) {
+		cache, _, _ := newStaleCache(t, serviceUnavailable)
+
+		assert.ErrorIs(t, cache.DeleteSecret(ctx, kid), ErrUnavailable)
+		assert.Equal(t, 0, cache.Len())
+	})
+}
+
+// invalidatingStorage calls invalidate while reading a secret.
+type invalidatingStorage struct {
+	Storage
+	invalidate func()
+}
+
+func (s invalidatingStorage) GetSecret(ctx context.Context, key string) ([]byte, error) {
+	s.invalidate()
+	return s.Storage.GetSecret(ctx, key)
+}
+
+func TestCacheConfig_validate(t *testing.T) {
+	assert.NoError(t, DefaultCacheConfig().validate())
+	assert.EqualError(t, CacheConfig{TTL: -1}.validate(), "cache TTL and stale grace period can't be negative")
+	assert.EqualError(t, CacheConfig{StaleGracePeriod: time.Minute}.validate(), "cache max entries must be positive")
+	assert.EqualError(t, CacheConfig{TTL: time.Minute}.validate(), "cache max entries must be positive")
+}
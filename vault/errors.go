@@ -0,0 +1,126 @@
+/*
+ * Copyright (C) 2023 Nuts community
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package vault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	vaultapi "github.com/hashicorp/vault/api"
+)
+
+// invalidPathMessages are the messages of Vault's 400 Bad Request responses caused by the path of the request,
+// and thus by the key. Other messages mentioning the path (e.g. "invalid path for a versioned K/V secrets engine")
+// are caused by the configuration of the proxy or Vault, which must not be blamed on the client.
+var invalidPathMessages = []string{
+	"invalid path",
+	"cannot write to a path ending in '/'",
+}
+
+// classifyError wraps an error returned by the Vault client with the error describing its cause (e.g. ErrSealed),
+// so callers can tell the causes apart using errors.Is. Errors with other causes are returned as-is.
+func classifyError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var cause error
+	var responseError *vaultapi.ResponseError
+	var urlError *url.Error
+	switch {
+	case errors.As(err, &responseError):
+		cause = responseErrorCause(responseError)
+	case errors.Is(err, context.DeadlineExceeded):
+		cause = ErrTimeout
+	case errors.As(err, &urlError):
+		// the HTTP client returns url.Errors when it can't connect to Vault or the connection fails
+		if urlError.Timeout() {
+			cause = ErrTimeout
+		} else {
+			cause = ErrUnavailable
+		}
+	}
+	if cause == nil {
+		return err
+	}
+	return fmt.Errorf("%w: %w", cause, err)
+}
+
+// responseErrorCause returns the cause of an error response from Vault, or nil if it has no specific cause.
+func responseErrorCause(responseError *vaultapi.ResponseError) error {
+	switch responseError.StatusCode {
+	case http.StatusForbidden:
+		return ErrPermissionDenied
+	case http.StatusTooManyRequests:
+		return ErrRateLimited
+	case http.StatusNotFound, http.StatusMethodNotAllowed:
+		return ErrInvalidPath
+	case http.StatusBadRequest:
+		for _, message := range responseError.Errors {
+			if slices.Contains(invalidPathMessages, message) {
+				return ErrInvalidPath
+			}
+		}
+	case http.StatusBadGateway:
+		return ErrUnavailable
+	case http.StatusGatewayTimeout:
+		return ErrTimeout
+	case http.StatusServiceUnavailable:
+		for _, message := range responseError.Errors {
+			if strings.Contains(message, "Vault is sealed") {
+				return ErrSealed
+			}
+		}
+		return ErrUnavailable
+	}
+	return nil
+}
+
+// classifyingClient is a vaultClient which classifies the errors returned by the wrapped client using classifyError.
+type classifyingClient struct {
+	client vaultClient
+}
+
+func (c classifyingClient) ReadWithContext(ctx context.Context, path string) (*vaultapi.Secret, error) {
+	secret, err := c.client.ReadWithContext(ctx, path)
+	return secret, classifyError(err)
+}
+
+func (c classifyingClient) WriteWithContext(ctx context.Context, path string, data map[string]interface{}) (*vaultapi.Secret, error) {
+	secret, err := c.client.WriteWithContext(ctx, path, data)
+	return secret, classifyError(err)
+}
+
+func (c classifyingClient) ListWithContext(ctx context.Context, path string) (*vaultapi.Secret, error) {
+	secret, err := c.client.ListWithContext(ctx, path)
+	return secret, classifyError(err)
+}
+
+func (c classifyingClient) ReadWithDataWithContext(ctx context.Context, path string, data map[string][]string) (*vaultapi.Secret, error) {
+	secret, err := c.client.ReadWithDataWithContext(ctx, path, data)
+	return secret, classifyError(err)
+}
+
+func (c classifyingClient) DeleteWithContext(ctx context.Context, path string) (*vaultapi.Secret, error) {
+	secret, err := c.client.DeleteWithContext(ctx, path)
+	return secret, classifyError(err)
+}
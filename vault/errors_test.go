@@ -0,0 +1,101 @@
+/*
+ * Copyright (C) 2023 Nuts community
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package vault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"testing"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	"github.com/stretchr/testify/assert"
+)
+
+// timeoutError is a net.Error that timed out
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClassifyError(t *testing.T) {
+	testCases := []struct {
+		name     string
+		err      error
+		expected error
+	}{
+		{name: "permission denied", err: &vaultapi.ResponseError{StatusCode: 403, Errors: []string{"permission denied"}}, expected: ErrPermissionDenied},
+		{name: "rate limited", err: &vaultapi.ResponseError{StatusCode: 429, Errors: []string{"rate limit quota exceeded"}}, expected: ErrRateLimited},
+		{name: "no handler for route", err: &vaultapi.ResponseError{StatusCode: 404, Errors: []string{"no handler for route"}}, expected: ErrInvalidPath},
+		{name: "unsupported operation", err: &vaultapi.ResponseError{StatusCode: 405, Errors: []string{"unsupported operation"}}, expected: ErrInvalidPath},
+		{name: "invalid path", err: &vaultapi.ResponseError{StatusCode: 400, Errors: []string{"invalid path"}}, expected: ErrInvalidPath},
+		{name: "path ending in a slash", err: &vaultapi.ResponseError{StatusCode: 400, Errors: []string{"cannot write to a path ending in '/'"}}, expected: ErrInvalidPath},
+		{name: "bad gateway", err: &vaultapi.ResponseError{StatusCode: 502}, expected: ErrUnavailable},
+		{name: "gateway timeout", err: &vaultapi.ResponseError{StatusCode: 504}, expected: ErrTimeout},
+		{name: "sealed", err: &vaultapi.ResponseError{StatusCode: 503, Errors: []string{"Vault is sealed"}}, expected: ErrSealed},
+		{name: "service unavailable", err: &vaultapi.ResponseError{StatusCode: 503, Errors: []string{"local node not active but active cluster node not found"}}, expected: ErrUnavailable},
+		{name: "unreachable", err: &url.Error{Op: "Get", URL: "http://vault:8200/v1/kv/key", Err: errors.New("connection refused")}, expected: ErrUnavailable},
+		{name: "client timeout", err: &url.Error{Op: "Get", URL: "http://vault:8200/v1/kv/key", Err: timeoutError{}}, expected: ErrTimeout},
+		{name: "context deadline exceeded", err: fmt.Errorf("request failed: %w", context.DeadlineExceeded), expected: ErrTimeout},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			result := classifyError(testCase.err)
+			assert.ErrorIs(t, result, testCase.expected)
+			assert.ErrorIs(t, result, testCase.err, "original error should be retained")
+		})
+	}
+
+	t.Run("nil", func(t *testing.T) {
+		assert.NoError(t, classifyError(nil))
+	})
+	t.Run("sealed is not only unavailable", func(t *testing.T) {
+		result := classifyError(&vaultapi.ResponseError{StatusCode: 503, Errors: []string{"local node not active but active cluster node not found"}})
+		assert.NotErrorIs(t, result, ErrSealed)
+	})
+	t.Run("versioned K/V secrets engine is not an invalid path", func(t *testing.T) {
+		err := &vaultapi.ResponseError{StatusCode: 400, Errors: []string{"Invalid path for a versioned K/V secrets engine. See the API docs for the appropriate API endpoints to use. If using the Vault CLI, use 'vault kv get' for this operation."}}
+		assert.Same(t, err, classifyError(err))
+	})
+	t.Run("other error response", func(t *testing.T) {
+		err := &vaultapi.ResponseError{StatusCode: 400, Errors: []string{"check-and-set parameter did not match the current version"}}
+		assert.Same(t, err, classifyError(err))
+	})
+	t.Run("other error", func(t *testing.T) {
+		assert.Same(t, vaultError, classifyError(vaultError))
+	})
+}
+
+func TestClassifyingClient(t *testing.T) {
+	sealed := &vaultapi.ResponseError{StatusCode: 503, Errors: []string{"Vault is sealed"}}
+	client := classifyingClient{client: mockVaultClient{err: sealed}}
+	ctx := context.Background()
+
+	_, err := client.ReadWithContext(ctx, "kv/key")
+	assert.ErrorIs(t, err, ErrSealed)
+	_, err = client.WriteWithContext(ctx, "kv/key", nil)
+	assert.ErrorIs(t, err, ErrSealed)
+	_, err = client.ListWithContext(ctx, "kv")
+	assert.ErrorIs(t, err, ErrSealed)
+	_, err = client.ReadWithDataWithContext(ctx, "kv/key", nil)
+	assert.ErrorIs(t, err, ErrSealed)
+	_, err = client.DeleteWithContext(ctx, "kv/key")
+	assert.ErrorIs(t, err, ErrSealed)
+}
@@ -18,44 +18,197 @@
 package vault
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
 	"path/filepath"
+	"strings"
+	"time"
 
 	vaultapi "github.com/hashicorp/vault/api"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
 )
 
 const keyName = "key"
 
+// capabilitiesProbeKey is the key used to check the capabilities of the token on the paths of individual secrets.
+const capabilitiesProbeKey = "capabilities-check"
+
+// checkAndSetMismatch is the error Vault returns when a KV version 2 check-and-set write is rejected.
+const checkAndSetMismatch = "check-and-set parameter did not match the current version"
+
+// Supported versions of the KV secrets engine: https://developer.hashicorp.com/vault/docs/secrets/kv
+const (
+	KVVersion1 = 1
+	KVVersion2 = 2
+)
+
+// Config contains the settings for the Vault KV storage backend.
+type Config struct {
+	// MountPath is the path on which the KV secrets engine is mounted (e.g. kv).
+	MountPath string
+	// PathName is the (optional) path within the secrets engine under which the secrets are stored.
+	PathName string
+	// KVVersion is the version of the KV secrets engine mounted on MountPath.
+	// If zero, the version (and the actual mount path) is detected from Vault's mount information at startup.
+	KVVersion int
+	// Auth configures how the Vault token is obtained.
+	Auth AuthConfig
+	// RequestTimeout is the maximum duration of the Vault requests for a single storage operation. If zero, only the timeout of the Vault client applies.
+	RequestTimeout time.Duration
+	// Retry configures how requests failing with a transient error are retried.
+	Retry RetryConfig
+	// Breaker configures the circuit breaker, which fails requests fast while Vault is failing.
+	Breaker BreakerConfig
+	// Limiter configures the maximum number of concurrent requests to Vault.
+	Limiter LimiterConfig
+}
+
 type KVStorage struct {
 	client     vaultClient
+	sys        sysClient
 	pathPrefix string
+	// mountPath is only used for KV version 2, which expects the data/ and metadata/ segments directly after the mount path.
+	mountPath string
+	version   int
+	// requestTimeout is the deadline applied to each storage operation, if not zero.
+	requestTimeout time.Duration
+	// breaker is the circuit breaker in front of the client, nil if disabled.
+	breaker *circuitBreaker
+	// limiter limits the concurrent requests to Vault, nil if disabled.
+	limiter *limiter
+	// flights coalesces concurrent identical reads, nil if disabled.
+	flights *singleflight.Group
 }
 
 // vaultClient is an interface which has been implemented by the mockVaultClient and real vault.Logical to allow testing vault without the server.
 type vaultClient interface {
-	Read(path string) (*vaultapi.Secret, error)
-	Write(path string, data map[string]interface{}) (*vaultapi.Secret, error)
-	List(path string) (*vaultapi.Secret, error)
-	ReadWithData(path string, data map[string][]string) (*vaultapi.Secret, error)
-	Delete(path string) (*vaultapi.Secret, error)
+	ReadWithContext(ctx context.Context, path string) (*vaultapi.Secret, error)
+	WriteWithContext(ctx context.Context, path string, data map[string]interface{}) (*vaultapi.Secret, error)
+	ListWithContext(ctx context.Context, path string) (*vaultapi.Secret, error)
+	ReadWithDataWithContext(ctx context.Context, path string, data map[string][]string) (*vaultapi.Secret, error)
+	DeleteWithContext(ctx context.Context, path string) (*vaultapi.Secret, error)
+}
+
+// sysClient is an interface which has been implemented by vault.Sys to allow testing the Vault server status without the server.
+type sysClient interface {
+	HealthWithContext(ctx context.Context) (*vaultapi.HealthResponse, error)
 }
 
-// NewKVStore creates a new Vault backend using the kv version 1 secret engine: https://www.vaultproject.io/docs/secrets/kv
-// It currently only supports token authentication which should be provided by the token param.
-// If config.Address is empty, the VAULT_ADDR environment should be set.
-// If config.Token is empty, the VAULT_TOKEN environment should be is set.
-func NewKVStore(pathPrefix string) (Storage, error) {
-	client, err := configureVaultClient()
+// NewKVStore creates a new Vault backend using the kv version 1 or version 2 secret engine: https://www.vaultproject.io/docs/secrets/kv
+// The token is either provided through the VAULT_TOKEN environment variable or obtained by logging in with the configured auth method.
+// The VAULT_ADDR environment variable should be set to the address of the Vault server.
+func NewKVStore(config Config) (Storage, error) {
+	if config.KVVersion != 0 && config.KVVersion != KVVersion1 && config.KVVersion != KVVersion2 {
+		return nil, fmt.Errorf("unsupported KV secrets engine version: %d", config.KVVersion)
+	}
+	if err := config.Retry.validate(); err != nil {
+		return nil, err
+	}
+	if err := config.Breaker.validate(); err != nil {
+		return nil, err
+	}
+	if err := config.Limiter.validate(); err != nil {
+		return nil, err
+	}
+	// JoinPath will only add a slash if PathName is set
+	pathPrefix, err := url.JoinPath(config.MountPath, config.PathName)
+	if err != nil {
+		return nil, fmt.Errorf("unable to assemble vault secret path: %w", err)
+	}
+
+	authMethod, err := newAuthMethod(config.Auth)
 	if err != nil {
 		return nil, err
 	}
+	client, err := configureVaultClient(authMethod)
+	if err != nil {
+		return nil, err
+	}
+	auth := authenticator{client: client, method: authMethod}
+	if authMethod != nil {
+		secret, err := auth.login(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		logrus.Infof("Logged in to Vault using the %s auth method", config.Auth.Method)
+		go auth.run(context.Background(), secret)
+	} else if secret, err := auth.lookupToken(); err != nil {
+		logrus.WithError(err).Warn("Vault token won't be renewed")
+	} else {
+		go auth.run(context.Background(), secret)
+	}
 
-	return KVStorage{client: client.Logical(), pathPrefix: pathPrefix}, nil
+	// Requests pass the circuit breaker first, then are retried, with every attempt waiting for the limiter and traced.
+	var logical vaultClient = newTracingClient(metricsClient{client: classifyingClient{client: client.Logical()}})
+	var limiter *limiter
+	if config.Limiter.MaxConcurrent > 0 {
+		limiter = newLimiter(config.Limiter)
+		logical = limitingClient{client: logical, limiter: limiter}
+	}
+	logical = newRetryingClient(logical, config.Retry)
+	var breaker *circuitBreaker
+	if config.Breaker.FailureThreshold > 0 {
+		breaker = newCircuitBreaker(config.Breaker)
+		logical = breakerClient{client: logical, breaker: breaker}
+	}
+	storage := KVStorage{client: logical, sys: client.Sys(), pathPrefix: pathPrefix, mountPath: config.MountPath, version: config.KVVersion, requestTimeout: config.RequestTimeout, breaker: breaker, limiter: limiter, flights: &singleflight.Group{}}
+	if storage.version == 0 {
+		storage.mountPath, storage.version, err = detectKVMount(context.Background(), storage.client, pathPrefix)
+		if err != nil {
+			return nil, err
+		}
+		logrus.Infof("Detected KV version %d secrets engine mounted on '%s'", storage.version, storage.mountPath)
+	}
+	return storage, nil
 }
 
-func configureVaultClient() (*vaultapi.Client, error) {
+// detectKVMount looks up the secrets engine backing the given path and returns its mount path and KV version.
+// It fails if there is no secrets engine mounted on the path or if it isn't a KV secrets engine.
+func detectKVMount(ctx context.Context, client vaultClient, path string) (string, int, error) {
+	result, err := client.ReadWithContext(ctx, "sys/internal/ui/mounts/"+path)
+	if err != nil {
+		return "", 0, fmt.Errorf("unable to read the secrets engine mount of '%s' (is the path prefix correct and does the token have access to it?): %w", path, err)
+	}
+	if result == nil || result.Data == nil {
+		return "", 0, fmt.Errorf("no secrets engine mounted on '%s'", path)
+	}
+	// Vault versions before 0.10 report KV version 1 engines as 'generic'
+	engineType, _ := result.Data["type"].(string)
+	if engineType != "kv" && engineType != "generic" {
+		return "", 0, fmt.Errorf("secrets engine mounted on '%s' is of type '%s', expected a KV secrets engine", path, engineType)
+	}
+	mountPath, _ := result.Data["path"].(string)
+	mountPath = strings.TrimSuffix(mountPath, "/")
+	if mountPath == "" {
+		return "", 0, fmt.Errorf("unable to determine the mount path of the secrets engine for '%s'", path)
+	}
+	options, _ := result.Data["options"].(map[string]interface{})
+	switch options["version"] {
+	case nil, "", "1":
+		return mountPath, KVVersion1, nil
+	case "2":
+		return mountPath, KVVersion2, nil
+	default:
+		return "", 0, fmt.Errorf("secrets engine mounted on '%s' has unsupported KV version: %v", path, options["version"])
+	}
+}
+
+func configureVaultClient(authMethod vaultapi.AuthMethod) (*vaultapi.Client, error) {
 	vaultConfig := vaultapi.DefaultConfig()
+	// the Vault client would also retry non-idempotent requests, retries are done by the retryingClient instead
+	vaultConfig.MaxRetries = 0
+	if method, ok := authMethod.(certAuth); ok {
+		// the cert auth method authenticates the client certificate presented in the TLS handshake
+		transport, ok := vaultConfig.HttpClient.Transport.(*http.Transport)
+		if !ok || transport.TLSClientConfig == nil {
+			return nil, fmt.Errorf("unable to configure Vault client certificate")
+		}
+		transport.TLSClientConfig.GetClientCertificate = method.certificate.get
+	}
 	client, err := vaultapi.NewClient(vaultConfig)
 	if err != nil {
 		return nil, fmt.Errorf("unable to initialize Vault client: %w", err)
@@ -64,39 +217,139 @@ func configureVaultClient() (*vaultapi.Client, error) {
 	return client, nil
 }
 
-func (v KVStorage) Ping() error {
-	// Perform a token introspection to test the connection. This should be allowed by the default vault token policy.
+func (v KVStorage) Ping(ctx context.Context) (Status, error) {
+	// the health check must not fail because the proxy is busy, which would e.g. make a liveness probe restart it
+	ctx, cancel := v.withTimeout(WithoutLimit(ctx))
+	defer cancel()
 	logrus.Debug("Verifying Vault connection...")
-	secret, err := v.client.Read("auth/token/lookup-self")
+	state, err := v.vaultState(ctx)
+	status := Status{VaultState: state}
+	if v.breaker != nil {
+		status.CircuitBreaker = v.breaker.State()
+	}
+	if v.limiter != nil {
+		stats := v.limiter.Stats()
+		status.Limiter = &stats
+	}
+	if err != nil {
+		return status, err
+	}
+	// Perform a token introspection to test the connection. This should be allowed by the default vault token policy.
+	// When the circuit breaker is half-open, this acts as probe request.
+	secret, err := v.client.ReadWithContext(ctx, "auth/token/lookup-self")
+	if v.breaker != nil {
+		status.CircuitBreaker = v.breaker.State()
+	}
 	if err != nil {
-		return fmt.Errorf("unable to connect to Vault: unable to retrieve token status: %w", err)
+		return status, fmt.Errorf("unable to connect to Vault: unable to retrieve token status: %w", err)
 	}
 	if secret == nil || len(secret.Data) == 0 {
-		return fmt.Errorf("could not read token information on auth/token/lookup-self")
+		return status, fmt.Errorf("could not read token information on auth/token/lookup-self")
+	}
+	if status.TokenTTL, err = secret.TokenTTL(); err != nil {
+		return status, fmt.Errorf("could not read token TTL: %w", err)
+	}
+	if status.TokenRenewable, err = secret.TokenIsRenewable(); err != nil {
+		return status, fmt.Errorf("could not read whether token is renewable: %w", err)
+	}
+	if status.TokenRemainingUses, err = secret.TokenRemainingUses(); err != nil {
+		return status, fmt.Errorf("could not read remaining token uses: %w", err)
 	}
 	logrus.Debug("Vault connection verified")
-	return nil
+	return status, nil
+}
+
+// vaultState determines the state of the Vault server using sys/health. It returns an error if Vault can't serve requests.
+func (v KVStorage) vaultState(ctx context.Context) (string, error) {
+	health, err := v.sys.HealthWithContext(ctx)
+	if err != nil {
+		return VaultStateUnreachable, fmt.Errorf("%w: unable to retrieve health status: %w", ErrUnavailable, err)
+	}
+	switch {
+	case !health.Initialized:
+		return VaultStateUninitialized, fmt.Errorf("%w: vault is not initialized", ErrUnavailable)
+	case health.Sealed:
+		return VaultStateSealed, ErrSealed
+	case health.PerformanceStandby:
+		return VaultStatePerformanceStandby, nil
+	case health.Standby:
+		return VaultStateStandby, nil
+	default:
+		return VaultStateActive, nil
+	}
+}
+
+// MissingCapabilities checks the capabilities of the token on the paths used by the storage, using a probe key for secret paths.
+func (v KVStorage) MissingCapabilities(ctx context.Context) ([]string, error) {
+	// like Ping, this is part of the health check
+	ctx, cancel := v.withTimeout(WithoutLimit(ctx))
+	defer cancel()
+	required := []struct {
+		path         string
+		capabilities []string
+	}{
+		{path: v.dataPath(capabilitiesProbeKey), capabilities: []string{"read", "create"}},
+		{path: v.deletePath(capabilitiesProbeKey), capabilities: []string{"delete"}},
+		// Vault appends a slash to the path of list requests when checking policies
+		{path: v.listPath() + "/", capabilities: []string{"list"}},
+	}
+	var paths []string
+	for _, r := range required {
+		paths = append(paths, r.path)
+	}
+	result, err := v.client.WriteWithContext(ctx, "sys/capabilities-self", map[string]interface{}{"paths": paths})
+	if err != nil {
+		return nil, fmt.Errorf("unable to check token capabilities: %w", err)
+	}
+	if result == nil || result.Data == nil {
+		return nil, fmt.Errorf("unable to check token capabilities: empty response")
+	}
+	var missing []string
+	for _, r := range required {
+		granted := map[string]bool{}
+		values, _ := result.Data[r.path].([]interface{})
+		for _, value := range values {
+			if capability, ok := value.(string); ok {
+				granted[capability] = true
+			}
+		}
+		for _, capability := range r.capabilities {
+			if !granted[capability] && !granted["root"] {
+				missing = append(missing, fmt.Sprintf("%s on %s", capability, r.path))
+			}
+		}
+	}
+	return missing, nil
 }
 
-func (v KVStorage) GetSecret(key string) ([]byte, error) {
-	path := storagePath(v.pathPrefix, key)
-	value, err := v.getValue(path, keyName)
+// GetSecret reads the secret from Vault. Concurrent calls for the same key share a single Vault request.
+func (v KVStorage) GetSecret(ctx context.Context, key string) ([]byte, error) {
+	path := v.dataPath(key)
+	value, err := v.coalesce(ctx, "read "+path, func(ctx context.Context) (interface{}, error) {
+		return v.getValue(ctx, path, keyName)
+	})
 	if err != nil {
 		return nil, err
 	}
-	return value, nil
+	// callers may modify or zero the value, so they each get their own copy
+	return clone(value.([]byte)), nil
 }
 
 // getValue extracts a field with name as provided by the key param from the Vault response.
-func (v KVStorage) getValue(path, key string) ([]byte, error) {
-	result, err := v.client.Read(path)
+func (v KVStorage) getValue(ctx context.Context, path, key string) ([]byte, error) {
+	result, err := v.client.ReadWithContext(ctx, path)
 	if err != nil {
 		return nil, fmt.Errorf("unable to read key from vault: %w", err)
 	}
 	if result == nil || result.Data == nil {
 		return nil, ErrNotFound
 	}
-	rawValue, ok := result.Data[key]
+	data := result.Data
+	if v.version == KVVersion2 {
+		// KV version 2 wraps the secret in a data field, which is empty if the latest version has been deleted.
+		data, _ = result.Data["data"].(map[string]interface{})
+	}
+	rawValue, ok := data[key]
 	if !ok {
 		return nil, ErrNotFound
 	}
@@ -108,33 +361,73 @@ func (v KVStorage) getValue(path, key string) ([]byte, error) {
 	return []byte(value), nil
 }
 
-func (v KVStorage) storeValue(path, key string, value []byte) error {
+func (v KVStorage) storeValue(ctx context.Context, path, key string, value []byte) error {
 	// convert to string to prevent base64 encoding
 	stringValue := string(value)
-	_, err := v.client.Write(path, map[string]interface{}{key: stringValue})
+	data := map[string]interface{}{key: stringValue}
+	if v.version == KVVersion2 {
+		// check-and-set version 0 only allows the write if the key doesn't exist yet
+		data = map[string]interface{}{
+			"options": map[string]interface{}{"cas": 0},
+			"data":    data,
+		}
+	}
+	_, err := v.client.WriteWithContext(ctx, path, data)
 	if err != nil {
+		if isCheckAndSetMismatch(err) {
+			return ErrKeyAlreadyExists
+		}
 		return fmt.Errorf("unable to write secret to vault: %w", err)
 	}
 	return nil
 }
 
-func (v KVStorage) DeleteSecret(key string) error {
-	_, err := v.GetSecret(key)
+// isCheckAndSetMismatch returns true if Vault rejected a write because the check-and-set version did not match.
+func isCheckAndSetMismatch(err error) bool {
+	var responseError *vaultapi.ResponseError
+	if !errors.As(err, &responseError) || responseError.StatusCode != 400 {
+		return false
+	}
+	for _, message := range responseError.Errors {
+		if strings.Contains(message, checkAndSetMismatch) {
+			return true
+		}
+	}
+	return false
+}
+
+func (v KVStorage) DeleteSecret(ctx context.Context, key string) error {
+	ctx, cancel := v.withTimeout(ctx)
+	defer cancel()
+	// not coalesced, since a read started before a concurrent write could be outdated
+	_, err := v.getValue(ctx, v.dataPath(key), keyName)
 	if err != nil {
 		return err
 	}
-	path := storagePath(v.pathPrefix, key)
-	_, err = v.client.Delete(path)
+	_, err = v.client.DeleteWithContext(ctx, v.deletePath(key))
 	if err != nil {
 		return fmt.Errorf("unable to delete secret from vault: %w", err)
 	}
+	// a read or list started before the delete could still return the secret, later calls must not share it
+	v.forget("read " + v.dataPath(key))
+	v.forget("list")
 	return nil
 }
 
 // ListKeys returns a list of all keys in the vault storage for the given path.
-func (v KVStorage) ListKeys() ([]string, error) {
-	path := privateKeyListPath(v.pathPrefix)
-	response, err := v.client.List(path)
+// Concurrent calls share a single Vault request.
+func (v KVStorage) ListKeys(ctx context.Context) ([]string, error) {
+	keys, err := v.coalesce(ctx, "list", func(ctx context.Context) (interface{}, error) {
+		return v.listKeys(ctx)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append([]string(nil), keys.([]string)...), nil
+}
+
+func (v KVStorage) listKeys(ctx context.Context) ([]string, error) {
+	response, err := v.client.ListWithContext(ctx, v.listPath())
 	if err != nil {
 		logrus.WithError(err).Error("Could not list private keys in Vault")
 		return nil, err
@@ -157,7 +450,13 @@ func (v KVStorage) ListKeys() ([]string, error) {
 // storagePath cleans the key by removing optional slashes and dots and constructs the key path
 // This prevents “dot-dot-slash” aka “directory traversal” attacks.
 func storagePath(prefix, key string) string {
-	return filepath.Clean(fmt.Sprintf("%s/%s", prefix, filepath.Base(key)))
+	return filepath.Clean(fmt.Sprintf("%s/%s", prefix, normalizeKey(key)))
+}
+
+// normalizeKey returns the key as stored in Vault, which is its last path element.
+// Different spellings of a key (e.g. "a/kid" and "kid") refer to the same secret.
+func normalizeKey(key string) string {
+	return filepath.Base(key)
 }
 
 func privateKeyListPath(prefix string) string {
@@ -165,12 +464,121 @@ func privateKeyListPath(prefix string) string {
 	return filepath.Clean(path)
 }
 
-func (v KVStorage) StoreSecret(key string, value []byte) error {
-	path := storagePath(v.pathPrefix, key)
+// unlimitedFlightSuffix separates the coalesced calls that bypass the limiter from the others.
+const unlimitedFlightSuffix = " (unlimited)"
+
+// coalesce calls fn, unless a call with the same key is already in flight, in which case it waits for its result instead.
+// The shared call isn't cancelled when a caller's context is done, it only ends at the configured request timeout
+// (which is applied by coalesce). Callers must not modify the returned value.
+func (v KVStorage) coalesce(ctx context.Context, key string, fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	if v.flights == nil {
+		ctx, cancel := v.withTimeout(ctx)
+		defer cancel()
+		return fn(ctx)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, classifyError(err)
+	}
+	if isUnlimited(ctx) {
+		// don't join (or let others join) a call waiting for the limiter
+		key += unlimitedFlightSuffix
+	}
+	// the caller that starts the call might leave before the others, so the call must not depend on its context
+	flightCtx := context.WithoutCancel(ctx)
+	result := v.flights.DoChan(key, func() (interface{}, error) {
+		ctx, cancel := v.withTimeout(flightCtx)
+		defer cancel()
+		return fn(ctx)
+	})
+	select {
+	case r := <-result:
+		return r.Val, r.Err
+	case <-ctx.Done():
+		return nil, classifyError(ctx.Err())
+	}
+}
+
+// forget makes calls to coalesce with the given key start a new call, instead of waiting for the result of the call in flight.
+func (v KVStorage) forget(key string) {
+	if v.flights != nil {
+		v.flights.Forget(key)
+		v.flights.Forget(key + unlimitedFlightSuffix)
+	}
+}
+
+// withTimeout applies the configured request timeout to the context of a storage operation.
+func (v KVStorage) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if v.requestTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, v.requestTimeout)
+}
+
+// dataPath returns the path on which the secret for the given key is read and written.
+func (v KVStorage) dataPath(key string) string {
+	if v.version == KVVersion2 {
+		return storagePath(v.kv2Path("data"), key)
+	}
+	return storagePath(v.pathPrefix, key)
+}
+
+// deletePath returns the path on which the secret for the given key is deleted.
+func (v KVStorage) deletePath(key string) string {
+	if v.version == KVVersion2 {
+		// Deleting the metadata permanently removes all versions of the secret
+		return storagePath(v.kv2Path("metadata"), key)
+	}
+	return storagePath(v.pathPrefix, key)
+}
+
+// listPath returns the path on which the keys are listed.
+func (v KVStorage) listPath() string {
+	if v.version == KVVersion2 {
+		return privateKeyListPath(v.kv2Path("metadata"))
+	}
+	return privateKeyListPath(v.pathPrefix)
+}
+
+// KeyPathPrefixes returns the Vault paths under which the keys are the last segment, e.g. to recognize keys in log messages.
+func (v KVStorage) KeyPathPrefixes() []string {
+	if v.version == KVVersion2 {
+		return []string{v.kv2Path("data"), v.kv2Path("metadata")}
+	}
+	return []string{v.pathPrefix}
+}
+
+// kv2Path inserts a KV version 2 API segment (data or metadata) between the mount path and the rest of the path prefix.
+func (v KVStorage) kv2Path(segment string) string {
+	relativePath := strings.TrimPrefix(strings.TrimPrefix(v.pathPrefix, v.mountPath), "/")
+	return filepath.Join(v.mountPath, segment, relativePath)
+}
+
+// StoreSecret stores the secret if no secret exists for the key yet, otherwise it returns ErrKeyAlreadyExists.
+func (v KVStorage) StoreSecret(ctx context.Context, key string, value []byte) error {
+	ctx, cancel := v.withTimeout(ctx)
+	defer cancel()
+	path := v.dataPath(key)
+	if err := v.storeSecret(ctx, path, value); err != nil {
+		return err
+	}
+	// a read or list started before the write could still miss the secret, later calls must not share it
+	v.forget("read " + path)
+	v.forget("list")
+	return nil
+}
+
+func (v KVStorage) storeSecret(ctx context.Context, path string, value []byte) error {
+	if v.version == KVVersion2 {
+		// the check-and-set write makes Vault reject the write atomically if the key already exists
+		return v.storeValue(ctx, path, keyName, value)
+	}
 
-	_, err := v.getValue(path, keyName)
+	// KV version 1 doesn't support check-and-set, so checking whether the key exists and writing it is serialized per path.
+	// This only prevents races between requests handled by this proxy instance.
+	defer writeLocks.lock(path)()
+	_, err := v.getValue(ctx, path, keyName)
 	if err == ErrNotFound {
-		return v.storeValue(path, keyName, value)
+		return v.storeValue(ctx, path, keyName, value)
 	}
 	if err != nil {
 		return err
@@ -18,13 +18,21 @@
 package vault
 
 import (
+	"context"
 	"encoding/base64"
 	"errors"
+	"fmt"
+	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	vault "github.com/hashicorp/vault/api"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/singleflight"
 )
 
 type mockVaultClient struct {
@@ -33,7 +41,7 @@ type mockVaultClient struct {
 	store map[string]map[string]interface{}
 }
 
-func (m mockVaultClient) Read(path string) (*vault.Secret, error) {
+func (m mockVaultClient) ReadWithContext(_ context.Context, path string) (*vault.Secret, error) {
 	if m.err != nil {
 		return nil, m.err
 	}
@@ -46,7 +54,7 @@ func (m mockVaultClient) Read(path string) (*vault.Secret, error) {
 	}, nil
 }
 
-func (m mockVaultClient) ReadWithData(path string, _ map[string][]string) (*vault.Secret, error) {
+func (m mockVaultClient) ReadWithDataWithContext(_ context.Context, path string, _ map[string][]string) (*vault.Secret, error) {
 	if m.err != nil {
 		return nil, m.err
 	}
@@ -55,17 +63,24 @@ func (m mockVaultClient) ReadWithData(path string, _ map[string][]string) (*vaul
 	}, nil
 }
 
-func (m mockVaultClient) Write(path string, data map[string]interface{}) (*vault.Secret, error) {
+func (m mockVaultClient) WriteWithContext(ctx context.Context, path string, data map[string]interface{}) (*vault.Secret, error) {
 	if m.err != nil {
 		return nil, m.err
 	}
+	// emulate KV version 2 check-and-set writes
+	if options, ok := data["options"].(map[string]interface{}); ok {
+		if _, exists := m.store[path]; exists && options["cas"] == 0 {
+			return nil, &vault.ResponseError{StatusCode: 400, Errors: []string{checkAndSetMismatch}}
+		}
+		data = map[string]interface{}{"data": data["data"]}
+	}
 	m.store[path] = data
 	return &vault.Secret{
 		Data: data,
 	}, nil
 }
 
-func (m mockVaultClient) List(path string) (*vault.Secret, error) {
+func (m mockVaultClient) ListWithContext(_ context.Context, path string) (*vault.Secret, error) {
 	if m.err != nil {
 		return nil, m.err
 	}
@@ -81,14 +96,88 @@ func (m mockVaultClient) List(path string) (*vault.Secret, error) {
 	}, nil
 }
 
-func (m mockVaultClient) Delete(path string) (*vault.Secret, error) {
+func (m mockVaultClient) DeleteWithContext(_ context.Context, path string) (*vault.Secret, error) {
 	if m.err != nil {
 		return nil, m.err
 	}
 	delete(m.store, path)
+	// deleting the metadata of a KV version 2 secret removes all of its versions
+	delete(m.store, strings.Replace(path, "/metadata/", "/data/", 1))
 	return &vault.Secret{}, nil
 }
 
+// mockSysClient returns the configured health status of the Vault server.
+type mockSysClient struct {
+	health *vault.HealthResponse
+	err    error
+}
+
+func (m mockSysClient) HealthWithContext(_ context.Context) (*vault.HealthResponse, error) {
+	return m.health, m.err
+}
+
+var activeVault = mockSysClient{health: &vault.HealthResponse{Initialized: true}}
+
+// lockingVaultClient makes the mockVaultClient safe for concurrent use.
+// Like Vault, it only makes individual calls atomic, not sequences of calls.
+type lockingVaultClient struct {
+	mockVaultClient
+	mutex *sync.Mutex
+}
+
+func (m lockingVaultClient) ReadWithContext(ctx context.Context, path string) (*vault.Secret, error) {
+	m.mutex.Lock()
+	result, err := m.mockVaultClient.ReadWithContext(ctx, path)
+	m.mutex.Unlock()
+	// give other goroutines the chance to interleave between reading and writing
+	runtime.Gosched()
+	return result, err
+}
+
+func (m lockingVaultClient) WriteWithContext(ctx context.Context, path string, data map[string]interface{}) (*vault.Secret, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.mockVaultClient.WriteWithContext(ctx, path, data)
+}
+
+func (m lockingVaultClient) ListWithContext(ctx context.Context, path string) (*vault.Secret, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.mockVaultClient.ListWithContext(ctx, path)
+}
+
+func (m lockingVaultClient) DeleteWithContext(ctx context.Context, path string) (*vault.Secret, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.mockVaultClient.DeleteWithContext(ctx, path)
+}
+
+// capabilitiesVaultClient returns the configured capabilities per path for sys/capabilities-self.
+type capabilitiesVaultClient struct {
+	mockVaultClient
+	capabilities map[string]interface{}
+}
+
+func (m capabilitiesVaultClient) WriteWithContext(ctx context.Context, path string, data map[string]interface{}) (*vault.Secret, error) {
+	if path != "sys/capabilities-self" {
+		return m.mockVaultClient.WriteWithContext(ctx, path, data)
+	}
+	if m.err != nil {
+		return nil, m.err
+	}
+	return &vault.Secret{Data: m.capabilities}, nil
+}
+
+// blockingVaultClient blocks reads until the context is done, like a Vault server that doesn't respond.
+type blockingVaultClient struct {
+	mockVaultClient
+}
+
+func (m blockingVaultClient) ReadWithContext(ctx context.Context, _ string) (*vault.Secret, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
 var secret = []byte("secret-value")
 var encodedSecret = []byte(base64.StdEncoding.EncodeToString(secret))
 
@@ -98,37 +187,38 @@ const kid = "did:nuts:123#abc"
 var vaultError = errors.New("vault error")
 
 func TestVaultKVStorage(t *testing.T) {
+	ctx := context.Background()
 
 	t.Run("ok - store and retrieve a secret", func(t *testing.T) {
 		vaultStorage := KVStorage{client: mockVaultClient{store: map[string]map[string]interface{}{}}}
-		result, err := vaultStorage.GetSecret(kid)
+		result, err := vaultStorage.GetSecret(ctx, kid)
 		assert.EqualError(t, err, ErrNotFound.Error(), "secret should not be found")
 		assert.Nil(t, result, "result should be nil")
 
-		assert.NoError(t, vaultStorage.StoreSecret(kid, secret), "storing secret should work")
+		assert.NoError(t, vaultStorage.StoreSecret(ctx, kid, secret), "storing secret should work")
 
-		result, err = vaultStorage.GetSecret(kid)
+		result, err = vaultStorage.GetSecret(ctx, kid)
 		assert.NoError(t, err)
 		assert.Equal(t, secret, result, "result should equal the secret")
 	})
 
 	t.Run("error - while writing", func(t *testing.T) {
 		v := KVStorage{client: mockVaultClient{err: vaultError}}
-		err := v.StoreSecret(kid, secret)
+		err := v.StoreSecret(ctx, kid, secret)
 		assert.Error(t, err, "saving should fail")
 		assert.ErrorIs(t, err, vaultError)
 	})
 
 	t.Run("error - while reading", func(t *testing.T) {
 		v := KVStorage{client: mockVaultClient{err: vaultError}}
-		_, err := v.GetSecret(kid)
+		_, err := v.GetSecret(ctx, kid)
 		assert.Error(t, err, "saving should fail")
 		assert.ErrorIs(t, err, vaultError)
 	})
 
 	t.Run("error - key not found (empty response)", func(t *testing.T) {
 		v := KVStorage{client: mockVaultClient{store: map[string]map[string]interface{}{}}}
-		_, err := v.GetSecret(kid)
+		_, err := v.GetSecret(ctx, kid)
 		assert.Error(t, err, "expected error on unknown kid")
 		assert.EqualError(t, err, ErrNotFound.Error())
 	})
@@ -138,7 +228,7 @@ func TestVaultKVStorage(t *testing.T) {
 			storagePath(prefix, kid): {"other-key": "other-value"},
 		}
 		v := KVStorage{pathPrefix: prefix, client: mockVaultClient{store: store}}
-		_, err := v.GetSecret(kid)
+		_, err := v.GetSecret(ctx, kid)
 		assert.Error(t, err, "expected error on unknown kid")
 		assert.EqualError(t, err, ErrNotFound.Error())
 	})
@@ -150,7 +240,7 @@ func TestVaultKVStorage(t *testing.T) {
 		v := KVStorage{pathPrefix: "kv", client: mockVaultClient{store: store}}
 
 		t.Run("GetPrivateKey", func(t *testing.T) {
-			_, err := v.GetSecret(kid)
+			_, err := v.GetSecret(ctx, kid)
 			assert.Error(t, err, "expected type conversion error on byte array")
 			assert.EqualError(t, err, "unable to convert key result to string")
 		})
@@ -158,45 +248,662 @@ func TestVaultKVStorage(t *testing.T) {
 
 	t.Run("error - key already exists", func(t *testing.T) {
 		v := KVStorage{pathPrefix: prefix, client: mockVaultClient{store: map[string]map[string]interface{}{storagePath(prefix, kid): {"key": string(encodedSecret)}}}}
-		assert.EqualError(t, v.StoreSecret(kid, secret), ErrKeyAlreadyExists.Error())
+		assert.EqualError(t, v.StoreSecret(ctx, kid, secret), ErrKeyAlreadyExists.Error())
+	})
+}
+
+func TestVaultKVStorage_Ping(t *testing.T) {
+	ctx := context.Background()
+	lookupSelf := mockVaultClient{store: map[string]map[string]interface{}{
+		"auth/token/lookup-self": {"ttl": 3600, "renewable": true, "num_uses": 5},
+	}}
+
+	t.Run("ok", func(t *testing.T) {
+		v := KVStorage{client: lookupSelf, sys: activeVault}
+		status, err := v.Ping(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, Status{VaultState: VaultStateActive, TokenTTL: time.Hour, TokenRenewable: true, TokenRemainingUses: 5}, status)
+	})
+	t.Run("ok - standby", func(t *testing.T) {
+		v := KVStorage{client: lookupSelf, sys: mockSysClient{health: &vault.HealthResponse{Initialized: true, Standby: true}}}
+		status, err := v.Ping(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, VaultStateStandby, status.VaultState)
+	})
+	t.Run("ok - performance standby", func(t *testing.T) {
+		v := KVStorage{client: lookupSelf, sys: mockSysClient{health: &vault.HealthResponse{Initialized: true, Standby: true, PerformanceStandby: true}}}
+		status, err := v.Ping(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, VaultStatePerformanceStandby, status.VaultState)
+	})
+	t.Run("error - sealed", func(t *testing.T) {
+		v := KVStorage{client: lookupSelf, sys: mockSysClient{health: &vault.HealthResponse{Initialized: true, Sealed: true}}}
+		status, err := v.Ping(ctx)
+		assert.ErrorIs(t, err, ErrSealed)
+		assert.Equal(t, VaultStateSealed, status.VaultState)
+	})
+	t.Run("error - not initialized", func(t *testing.T) {
+		v := KVStorage{client: lookupSelf, sys: mockSysClient{health: &vault.HealthResponse{}}}
+		status, err := v.Ping(ctx)
+		assert.ErrorIs(t, err, ErrUnavailable)
+		assert.Equal(t, VaultStateUninitialized, status.VaultState)
+	})
+	t.Run("error - unreachable", func(t *testing.T) {
+		v := KVStorage{client: lookupSelf, sys: mockSysClient{err: vaultError}}
+		status, err := v.Ping(ctx)
+		assert.ErrorIs(t, err, ErrUnavailable)
+		assert.ErrorIs(t, err, vaultError)
+		assert.Equal(t, VaultStateUnreachable, status.VaultState)
+	})
+	t.Run("error - no token information", func(t *testing.T) {
+		v := KVStorage{client: mockVaultClient{store: map[string]map[string]interface{}{}}, sys: activeVault}
+		_, err := v.Ping(ctx)
+		assert.EqualError(t, err, "could not read token information on auth/token/lookup-self")
+	})
+	t.Run("error - while reading", func(t *testing.T) {
+		v := KVStorage{client: mockVaultClient{err: vaultError}, sys: activeVault}
+		_, err := v.Ping(ctx)
+		assert.ErrorIs(t, err, vaultError)
+	})
+	t.Run("error - unexpected token information", func(t *testing.T) {
+		client := mockVaultClient{store: map[string]map[string]interface{}{
+			"auth/token/lookup-self": {"ttl": "not a duration"},
+		}}
+		breaker := newCircuitBreaker(DefaultBreakerConfig())
+		v := KVStorage{client: client, sys: activeVault, breaker: breaker, limiter: newLimiter(DefaultLimiterConfig())}
+		status, err := v.Ping(ctx)
+		assert.ErrorContains(t, err, "could not read token TTL")
+		assert.Equal(t, Status{VaultState: VaultStateActive, CircuitBreaker: CircuitBreakerClosed, Limiter: &LimiterStats{}}, status)
+	})
+}
+
+func TestVaultKVStorage_MissingCapabilities(t *testing.T) {
+	ctx := context.Background()
+	t.Run("ok - KV version 1", func(t *testing.T) {
+		v := KVStorage{pathPrefix: "kv/nuts", client: capabilitiesVaultClient{capabilities: map[string]interface{}{
+			"kv/nuts/capabilities-check": []interface{}{"create", "read", "delete"},
+			"kv/nuts/":                   []interface{}{"list"},
+		}}}
+		missing, err := v.MissingCapabilities(ctx)
+		assert.NoError(t, err)
+		assert.Empty(t, missing)
+	})
+	t.Run("ok - root token", func(t *testing.T) {
+		v := KVStorage{pathPrefix: "kv/nuts", client: capabilitiesVaultClient{capabilities: map[string]interface{}{
+			"kv/nuts/capabilities-check": []interface{}{"root"},
+			"kv/nuts/":                   []interface{}{"root"},
+		}}}
+		missing, err := v.MissingCapabilities(ctx)
+		assert.NoError(t, err)
+		assert.Empty(t, missing)
+	})
+	t.Run("missing - KV version 2", func(t *testing.T) {
+		v := KVStorage{pathPrefix: "kv/nuts", mountPath: "kv", version: KVVersion2, client: capabilitiesVaultClient{capabilities: map[string]interface{}{
+			"kv/data/nuts/capabilities-check":     []interface{}{"read"},
+			"kv/metadata/nuts/capabilities-check": []interface{}{"deny"},
+			"kv/metadata/nuts/":                   []interface{}{"list"},
+		}}}
+		missing, err := v.MissingCapabilities(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"create on kv/data/nuts/capabilities-check", "delete on kv/metadata/nuts/capabilities-check"}, missing)
+	})
+	t.Run("error - while checking", func(t *testing.T) {
+		v := KVStorage{pathPrefix: "kv/nuts", client: capabilitiesVaultClient{mockVaultClient: mockVaultClient{err: vaultError}}}
+		_, err := v.MissingCapabilities(ctx)
+		assert.ErrorIs(t, err, vaultError)
 	})
 }
 
 func TestVaultKVStorage_ListKeys(t *testing.T) {
+	ctx := context.Background()
 
 	t.Run("ok - list keys", func(t *testing.T) {
 		v := KVStorage{pathPrefix: prefix, client: mockVaultClient{store: map[string]map[string]interface{}{storagePath(prefix, kid): {"key": string(encodedSecret)}}}}
-		result, err := v.ListKeys()
+		result, err := v.ListKeys(ctx)
 		assert.NoError(t, err)
 		assert.Equal(t, []string{kid}, result)
 	})
 
 	t.Run("error - while listing", func(t *testing.T) {
 		v := KVStorage{pathPrefix: prefix, client: mockVaultClient{err: vaultError}}
-		_, err := v.ListKeys()
+		_, err := v.ListKeys(ctx)
 		assert.Error(t, err, "listing should fail")
 		assert.ErrorIs(t, err, vaultError)
 	})
 }
 
 func TestVaultKVStorage_DeleteKey(t *testing.T) {
+	ctx := context.Background()
 	t.Run("ok - delete key", func(t *testing.T) {
 		v := KVStorage{pathPrefix: prefix, client: mockVaultClient{store: map[string]map[string]interface{}{storagePath(prefix, kid): {"key": string(encodedSecret)}}}}
-		assert.NoError(t, v.DeleteSecret(kid))
-		result, err := v.GetSecret(kid)
+		assert.NoError(t, v.DeleteSecret(ctx, kid))
+		result, err := v.GetSecret(ctx, kid)
 		assert.EqualError(t, err, ErrNotFound.Error(), "secret should not be found")
 		assert.Nil(t, result, "result should be nil")
 	})
 
 	t.Run("error - while deleting", func(t *testing.T) {
 		v := KVStorage{pathPrefix: prefix, client: mockVaultClient{err: vaultError}}
-		err := v.DeleteSecret(kid)
+		err := v.DeleteSecret(ctx, kid)
 		assert.Error(t, err, "deleting should fail")
 		assert.ErrorIs(t, err, vaultError)
 	})
 
 	t.Run("error - key not found", func(t *testing.T) {
 		v := KVStorage{pathPrefix: prefix, client: mockVaultClient{store: map[string]map[string]interface{}{}}}
-		assert.EqualError(t, v.DeleteSecret(kid), ErrNotFound.Error())
+		assert.EqualError(t, v.DeleteSecret(ctx, kid), ErrNotFound.Error())
+	})
+}
+
+func TestVaultKVStorage_KVVersion2(t *testing.T) {
+	ctx := context.Background()
+	const mountPath = "secret"
+	const pathPrefix = "secret/nuts-private-keys"
+	dataPath := "secret/data/nuts-private-keys/" + kid
+
+	newStorage := func(store map[string]map[string]interface{}) KVStorage {
+		return KVStorage{pathPrefix: pathPrefix, mountPath: mountPath, version: KVVersion2, client: mockVaultClient{store: store}}
+	}
+
+	t.Run("ok - store and retrieve a secret", func(t *testing.T) {
+		store := map[string]map[string]interface{}{}
+		v := newStorage(store)
+
+		assert.NoError(t, v.StoreSecret(ctx, kid, secret), "storing secret should work")
+
+		assert.Equal(t, map[string]interface{}{"data": map[string]interface{}{"key": string(secret)}}, store[dataPath])
+		result, err := v.GetSecret(ctx, kid)
+		assert.NoError(t, err)
+		assert.Equal(t, secret, result, "result should equal the secret")
+	})
+
+	t.Run("ok - without path name", func(t *testing.T) {
+		store := map[string]map[string]interface{}{}
+		v := KVStorage{pathPrefix: mountPath, mountPath: mountPath, version: KVVersion2, client: mockVaultClient{store: store}}
+
+		assert.NoError(t, v.StoreSecret(ctx, kid, secret), "storing secret should work")
+
+		assert.Contains(t, store, "secret/data/"+kid)
 	})
+
+	t.Run("error - key already exists", func(t *testing.T) {
+		v := newStorage(map[string]map[string]interface{}{dataPath: {"data": map[string]interface{}{"key": string(secret)}}})
+		assert.EqualError(t, v.StoreSecret(ctx, kid, secret), ErrKeyAlreadyExists.Error())
+	})
+
+	t.Run("error - key not found (latest version deleted)", func(t *testing.T) {
+		v := newStorage(map[string]map[string]interface{}{dataPath: {"data": nil, "metadata": map[string]interface{}{"version": 2}}})
+		_, err := v.GetSecret(ctx, kid)
+		assert.EqualError(t, err, ErrNotFound.Error())
+	})
+
+	t.Run("ok - list keys", func(t *testing.T) {
+		v := newStorage(map[string]map[string]interface{}{dataPath: {"data": map[string]interface{}{"key": string(secret)}}})
+		result, err := v.ListKeys(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{kid}, result)
+	})
+
+	t.Run("ok - delete key", func(t *testing.T) {
+		v := newStorage(map[string]map[string]interface{}{dataPath: {"data": map[string]interface{}{"key": string(secret)}}})
+		assert.NoError(t, v.DeleteSecret(ctx, kid))
+		_, err := v.GetSecret(ctx, kid)
+		assert.EqualError(t, err, ErrNotFound.Error(), "secret should not be found")
+	})
+}
+
+func TestVaultKVStorage_paths(t *testing.T) {
+	t.Run("KV version 1", func(t *testing.T) {
+		v := KVStorage{pathPrefix: "kv/nuts-private-keys", mountPath: "kv", version: KVVersion1}
+		assert.Equal(t, "kv/nuts-private-keys/"+kid, v.dataPath(kid))
+		assert.Equal(t, []string{"kv/nuts-private-keys"}, v.KeyPathPrefixes())
+	})
+	t.Run("KV version 2", func(t *testing.T) {
+		v := KVStorage{pathPrefix: "kv/nuts-private-keys", mountPath: "kv", version: KVVersion2}
+		assert.Equal(t, "kv/data/nuts-private-keys/"+kid, v.dataPath(kid))
+		assert.Equal(t, "kv/metadata/nuts-private-keys", v.kv2Path("metadata"))
+		assert.Equal(t, []string{"kv/data/nuts-private-keys", "kv/metadata/nuts-private-keys"}, v.KeyPathPrefixes())
+	})
+	t.Run("KV version 2 - nested mount path", func(t *testing.T) {
+		v := KVStorage{pathPrefix: "team/kv/nuts", mountPath: "team/kv", version: KVVersion2}
+		assert.Equal(t, "team/kv/data/nuts/"+kid, v.dataPath(kid))
+	})
+}
+
+func TestNewKVStore(t *testing.T) {
+	t.Run("error - unsupported KV version", func(t *testing.T) {
+		_, err := NewKVStore(Config{MountPath: "kv", KVVersion: 3})
+		assert.EqualError(t, err, "unsupported KV secrets engine version: 3")
+	})
+}
+
+func TestDetectKVMount(t *testing.T) {
+	ctx := context.Background()
+	const path = "kv/nuts-private-keys"
+	const mountInfoPath = "sys/internal/ui/mounts/kv/nuts-private-keys"
+
+	t.Run("ok - KV version 1", func(t *testing.T) {
+		client := mockVaultClient{store: map[string]map[string]interface{}{
+			mountInfoPath: {"type": "kv", "path": "kv/", "options": map[string]interface{}{"version": "1"}},
+		}}
+		mountPath, version, err := detectKVMount(ctx, client, path)
+		assert.NoError(t, err)
+		assert.Equal(t, "kv", mountPath)
+		assert.Equal(t, KVVersion1, version)
+	})
+	t.Run("ok - KV version 1 without options", func(t *testing.T) {
+		client := mockVaultClient{store: map[string]map[string]interface{}{
+			mountInfoPath: {"type": "kv", "path": "kv/", "options": nil},
+		}}
+		_, version, err := detectKVMount(ctx, client, path)
+		assert.NoError(t, err)
+		assert.Equal(t, KVVersion1, version)
+	})
+	t.Run("ok - KV version 2", func(t *testing.T) {
+		client := mockVaultClient{store: map[string]map[string]interface{}{
+			mountInfoPath: {"type": "kv", "path": "kv/", "options": map[string]interface{}{"version": "2"}},
+		}}
+		mountPath, version, err := detectKVMount(ctx, client, path)
+		assert.NoError(t, err)
+		assert.Equal(t, "kv", mountPath)
+		assert.Equal(t, KVVersion2, version)
+	})
+	t.Run("error - no mount", func(t *testing.T) {
+		client := mockVaultClient{store: map[string]map[string]interface{}{}}
+		_, _, err := detectKVMount(ctx, client, path)
+		assert.EqualError(t, err, "no secrets engine mounted on 'kv/nuts-private-keys'")
+	})
+	t.Run("error - not a KV secrets engine", func(t *testing.T) {
+		client := mockVaultClient{store: map[string]map[string]interface{}{
+			mountInfoPath: {"type": "transit", "path": "kv/"},
+		}}
+		_, _, err := detectKVMount(ctx, client, path)
+		assert.EqualError(t, err, "secrets engine mounted on 'kv/nuts-private-keys' is of type 'transit', expected a KV secrets engine")
+	})
+	t.Run("error - unsupported version", func(t *testing.T) {
+		client := mockVaultClient{store: map[string]map[string]interface{}{
+			mountInfoPath: {"type": "kv", "path": "kv/", "options": map[string]interface{}{"version": "3"}},
+		}}
+		_, _, err := detectKVMount(ctx, client, path)
+		assert.EqualError(t, err, "secrets engine mounted on 'kv/nuts-private-keys' has unsupported KV version: 3")
+	})
+	t.Run("error - while reading", func(t *testing.T) {
+		_, _, err := detectKVMount(ctx, mockVaultClient{err: vaultError}, path)
+		assert.ErrorIs(t, err, vaultError)
+	})
+}
+
+func TestVaultKVStorage_context(t *testing.T) {
+	t.Run("request timeout", func(t *testing.T) {
+		v := KVStorage{client: classifyingClient{client: blockingVaultClient{}}, pathPrefix: prefix, requestTimeout: 10 * time.Millisecond}
+		_, err := v.GetSecret(context.Background(), kid)
+		assert.ErrorIs(t, err, ErrTimeout)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+	t.Run("request timeout does not extend the deadline of the caller", func(t *testing.T) {
+		v := KVStorage{client: blockingVaultClient{}, pathPrefix: prefix, requestTimeout: time.Hour}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, err := v.GetSecret(ctx, kid)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+	t.Run("cancelled by the caller", func(t *testing.T) {
+		v := KVStorage{client: blockingVaultClient{}, pathPrefix: prefix}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := v.GetSecret(ctx, kid)
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+}
+
+// slowVaultClient counts the reads and lists, which take the given delay or until release is closed.
+type slowVaultClient struct {
+	lockingVaultClient
+	delay   time.Duration
+	release chan struct{}
+	calls   *atomic.Int64
+}
+
+func newSlowVaultClient(delay time.Duration) slowVaultClient {
+	store := map[string]map[string]interface{}{storagePath(prefix, kid): {keyName: string(secret)}}
+	return slowVaultClient{
+		lockingVaultClient: lockingVaultClient{mockVaultClient: mockVaultClient{store: store}, mutex: &sync.Mutex{}},
+		delay:              delay,
+		release:            make(chan struct{}),
+		calls:              &atomic.Int64{},
+	}
+}
+
+func (m slowVaultClient) wait(ctx context.Context) error {
+	m.calls.Add(1)
+	select {
+	case <-time.After(m.delay):
+	case <-m.release:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
+
+func (m slowVaultClient) ReadWithContext(ctx context.Context, path string) (*vault.Secret, error) {
+	if err := m.wait(ctx); err != nil {
+		return nil, err
+	}
+	return m.lockingVaultClient.ReadWithContext(ctx, path)
+}
+
+func (m slowVaultClient) ListWithContext(ctx context.Context, path string) (*vault.Secret, error) {
+	if err := m.wait(ctx); err != nil {
+		return nil, err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.mockVaultClient.ListWithContext(ctx, path)
+}
+
+// outdatedReadVaultClient holds the result of the first read or list until release is closed, so it is outdated by writes in the meantime.
+type outdatedReadVaultClient struct {
+	lockingVaultClient
+	first   *atomic.Bool
+	started chan struct{}
+	release chan struct{}
+}
+
+func (m outdatedReadVaultClient) ReadWithContext(ctx context.Context, path string) (*vault.Secret, error) {
+	result, err := m.lockingVaultClient.ReadWithContext(ctx, path)
+	if m.first.CompareAndSwap(true, false) {
+		close(m.started)
+		<-m.release
+	}
+	return result, err
+}
+
+func (m outdatedReadVaultClient) ListWithContext(ctx context.Context, path string) (*vault.Secret, error) {
+	result, err := m.lockingVaultClient.ListWithContext(ctx, path)
+	if m.first.CompareAndSwap(true, false) {
+		close(m.started)
+		<-m.release
+	}
+	return result, err
+}
+
+func TestVaultKVStorage_coalescing(t *testing.T) {
+	const callers = 10
+	// callStorage calls the storage from all callers at once and waits until they are all waiting for Vault.
+	callStorage := func(client slowVaultClient, call func(v KVStorage) error) []error {
+		v := KVStorage{client: client, pathPrefix: prefix, flights: &singleflight.Group{}}
+		errs := make([]error, callers)
+		wg := sync.WaitGroup{}
+		for i := 0; i < callers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs[i] = call(v)
+			}(i)
+		}
+		// give all callers the chance to join the in-flight call before releasing it
+		time.Sleep(50 * time.Millisecond)
+		close(client.release)
+		wg.Wait()
+		return errs
+	}
+
+	t.Run("GetSecret", func(t *testing.T) {
+		client := newSlowVaultClient(time.Minute)
+		errs := callStorage(client, func(v KVStorage) error {
+			result, err := v.GetSecret(context.Background(), kid)
+			if err == nil && string(result) != string(secret) {
+				return fmt.Errorf("unexpected secret: %s", result)
+			}
+			return err
+		})
+		for _, err := range errs {
+			assert.NoError(t, err)
+		}
+		assert.Equal(t, int64(1), client.calls.Load())
+	})
+	t.Run("ListKeys", func(t *testing.T) {
+		client := newSlowVaultClient(time.Minute)
+		errs := callStorage(client, func(v KVStorage) error {
+			_, err := v.ListKeys(context.Background())
+			return err
+		})
+		for _, err := range errs {
+			assert.NoError(t, err)
+		}
+		assert.Equal(t, int64(1), client.calls.Load())
+	})
+	t.Run("callers get their own copy", func(t *testing.T) {
+		client := newSlowVaultClient(0)
+		v := KVStorage{client: client, pathPrefix: prefix, flights: &singleflight.Group{}}
+		result, err := v.GetSecret(context.Background(), kid)
+		require.NoError(t, err)
+		clear(result)
+
+		result, err = v.GetSecret(context.Background(), kid)
+
+		require.NoError(t, err)
+		assert.Equal(t, secret, result)
+	})
+	t.Run("caller leaving does not cancel the shared call", func(t *testing.T) {
+		client := newSlowVaultClient(time.Minute)
+		v := KVStorage{client: client, pathPrefix: prefix, flights: &singleflight.Group{}}
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			cancel()
+		}()
+		_, err := v.GetSecret(ctx, kid)
+		assert.ErrorIs(t, err, context.Canceled)
+
+		// the call started by the caller that left is still in flight, so this joins it
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			close(client.release)
+		}()
+		result, err := v.GetSecret(context.Background(), kid)
+
+		require.NoError(t, err)
+		assert.Equal(t, secret, result)
+		assert.Equal(t, int64(1), client.calls.Load())
+	})
+	outdatedReadClient := func() outdatedReadVaultClient {
+		client := outdatedReadVaultClient{
+			lockingVaultClient: lockingVaultClient{mockVaultClient: mockVaultClient{store: map[string]map[string]interface{}{}}, mutex: &sync.Mutex{}},
+			first:              &atomic.Bool{},
+			started:            make(chan struct{}),
+			release:            make(chan struct{}),
+		}
+		client.first.Store(true)
+		return client
+	}
+	t.Run("reads after storing a secret don't share a read started before", func(t *testing.T) {
+		client := outdatedReadClient()
+		v := KVStorage{client: client, pathPrefix: prefix, flights: &singleflight.Group{}}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			_, err := v.GetSecret(context.Background(), kid)
+			assert.ErrorIs(t, err, ErrNotFound)
+		}()
+		<-client.started
+		require.NoError(t, v.StoreSecret(context.Background(), kid, secret))
+		time.AfterFunc(50*time.Millisecond, func() { close(client.release) })
+
+		result, err := v.GetSecret(context.Background(), kid)
+
+		require.NoError(t, err)
+		assert.Equal(t, secret, result)
+		<-done
+	})
+	t.Run("reads after deleting a secret don't share a read started before", func(t *testing.T) {
+		client := outdatedReadClient()
+		client.store[storagePath(prefix, kid)] = map[string]interface{}{keyName: string(secret)}
+		v := KVStorage{client: client, pathPrefix: prefix, flights: &singleflight.Group{}}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			_, err := v.GetSecret(context.Background(), kid)
+			assert.NoError(t, err)
+		}()
+		<-client.started
+		require.NoError(t, v.DeleteSecret(context.Background(), kid))
+		time.AfterFunc(50*time.Millisecond, func() { close(client.release) })
+
+		_, err := v.GetSecret(context.Background(), kid)
+
+		assert.ErrorIs(t, err, ErrNotFound)
+		<-done
+	})
+	t.Run("lists after storing a secret don't share a list started before", func(t *testing.T) {
+		client := outdatedReadClient()
+		v := KVStorage{client: client, pathPrefix: prefix, flights: &singleflight.Group{}}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			keys, err := v.ListKeys(context.Background())
+			assert.NoError(t, err)
+			assert.Empty(t, keys)
+		}()
+		<-client.started
+		require.NoError(t, v.StoreSecret(context.Background(), kid, secret))
+		time.AfterFunc(50*time.Millisecond, func() { close(client.release) })
+
+		keys, err := v.ListKeys(context.Background())
+
+		require.NoError(t, err)
+		assert.Equal(t, []string{kid}, keys)
+		<-done
+	})
+	t.Run("lists after deleting a secret don't share a list started before", func(t *testing.T) {
+		client := outdatedReadClient()
+		client.store[storagePath(prefix, kid)] = map[string]interface{}{keyName: string(secret)}
+		v := KVStorage{client: client, pathPrefix: prefix, flights: &singleflight.Group{}}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			keys, err := v.ListKeys(context.Background())
+			assert.NoError(t, err)
+			assert.Equal(t, []string{kid}, keys)
+		}()
+		<-client.started
+		require.NoError(t, v.DeleteSecret(context.Background(), kid))
+		time.AfterFunc(50*time.Millisecond, func() { close(client.release) })
+
+		keys, err := v.ListKeys(context.Background())
+
+		require.NoError(t, err)
+		assert.Empty(t, keys)
+		<-done
+	})
+}
+
+// BenchmarkVaultKVStorage_GetSecret reads the same secret from parallel goroutines, with a Vault latency of 1ms.
+// The vault-calls/op metric shows the fraction of reads that resulted in a Vault request.
+func BenchmarkVaultKVStorage_GetSecret(b *testing.B) {
+	benchmarks := map[string]*singleflight.Group{
+		"without coalescing": nil,
+		"with coalescing":    {},
+	}
+	for name, flights := range benchmarks {
+		b.Run(name, func(b *testing.B) {
+			client := newSlowVaultClient(time.Millisecond)
+			v := KVStorage{client: client, pathPrefix: prefix, flights: flights}
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := v.GetSecret(context.Background(), kid); err != nil {
+						b.Error(err)
+					}
+				}
+			})
+			b.ReportMetric(float64(client.calls.Load())/float64(b.N), "vault-calls/op")
+		})
+	}
+}
+
+func TestVaultKVStorage_StoreSecret_Concurrent(t *testing.T) {
+	ctx := context.Background()
+	const writers = 50
+
+	test := func(t *testing.T, v KVStorage) {
+		var wg sync.WaitGroup
+		errs := make([]error, writers)
+		for i := 0; i < writers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs[i] = v.StoreSecret(ctx, kid, []byte(fmt.Sprintf("secret-%d", i)))
+			}(i)
+		}
+		wg.Wait()
+
+		winner := -1
+		for i, err := range errs {
+			if err == nil {
+				assert.Equal(t, -1, winner, "only one store should succeed")
+				winner = i
+				continue
+			}
+			assert.ErrorIs(t, err, ErrKeyAlreadyExists)
+		}
+		if !assert.NotEqual(t, -1, winner, "one store should succeed") {
+			return
+		}
+		result, err := v.GetSecret(ctx, kid)
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("secret-%d", winner), string(result), "stored secret should not be overwritten")
+	}
+
+	t.Run("KV version 1", func(t *testing.T) {
+		client := lockingVaultClient{mockVaultClient: mockVaultClient{store: map[string]map[string]interface{}{}}, mutex: &sync.Mutex{}}
+		test(t, KVStorage{pathPrefix: prefix, client: client})
+	})
+	t.Run("KV version 2", func(t *testing.T) {
+		client := lockingVaultClient{mockVaultClient: mockVaultClient{store: map[string]map[string]interface{}{}}, mutex: &sync.Mutex{}}
+		test(t, KVStorage{pathPrefix: prefix, mountPath: prefix, version: KVVersion2, client: client})
+	})
+}
+
+func TestPathLocks(t *testing.T) {
+	var locks pathLocks
+	unlock := locks.lock("a")
+	// a different path doesn't block
+	locks.lock("b")()
+
+	locked := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		unlock := locks.lock("a")
+		close(locked)
+		unlock()
+	}()
+	// wait until the second locker holds a reference, so it is (about to be) waiting for the lock
+	require.Eventually(t, func() bool {
+		select {
+		case <-locked:
+			return true
+		default:
+		}
+		locks.mutex.Lock()
+		defer locks.mutex.Unlock()
+		return locks.locks["a"].references == 2
+	}, 5*time.Second, time.Millisecond)
+	select {
+	case <-locked:
+		t.Fatal("lock on the same path should block")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("lock should be acquired after unlocking")
+	}
+	<-done
+	locks.mutex.Lock()
+	defer locks.mutex.Unlock()
+	assert.Empty(t, locks.locks, "unused locks should be removed")
 }
@@ -0,0 +1,198 @@
+/*
+ * Copyright (C) 2023 Nuts community
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package vault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	vaultapi "github.com/hashicorp/vault/api"
+)
+
+// LimiterConfig configures the maximum number of concurrent requests to Vault.
+type LimiterConfig struct {
+	// MaxConcurrent is the maximum number of concurrent requests to Vault. A value of 0 disables the limit.
+	MaxConcurrent int
+	// MaxQueued is the maximum number of requests waiting for one of the concurrent requests to finish.
+	// Requests arriving when the queue is full are rejected with ErrBusy.
+	MaxQueued int
+	// QueueTimeout is the maximum time a request waits in the queue before it is rejected with ErrBusy.
+	QueueTimeout time.Duration
+}
+
+// DefaultLimiterConfig returns the default limiter configuration, which doesn't limit the concurrent requests.
+func DefaultLimiterConfig() LimiterConfig {
+	return LimiterConfig{
+		MaxQueued:    100,
+		QueueTimeout: 5 * time.Second,
+	}
+}
+
+func (c LimiterConfig) validate() error {
+	if c.MaxConcurrent < 0 || c.MaxQueued < 0 {
+		return errors.New("maximum concurrent and queued requests can't be negative")
+	}
+	if c.MaxConcurrent > 0 && c.QueueTimeout <= 0 {
+		return errors.New("queue timeout must be positive")
+	}
+	return nil
+}
+
+// LimiterStats describes the requests to Vault as limited by the limiter.
+type LimiterStats struct {
+	// Active is the number of requests currently sent to Vault.
+	Active int
+	// Queued is the number of requests currently waiting to be sent to Vault.
+	Queued int
+	// Rejected is the total number of requests rejected because the queue was full or they waited too long.
+	Rejected uint64
+	// Waited is the total number of requests that had to wait in the queue.
+	Waited uint64
+	// WaitTime is the total time requests waited in the queue.
+	WaitTime time.Duration
+}
+
+// limiter limits the number of concurrent requests to Vault, letting a bounded number of requests wait for their turn.
+type limiter struct {
+	config LimiterConfig
+	// slots contains a value for every request being sent to Vault.
+	slots chan struct{}
+
+	mux   sync.Mutex
+	stats LimiterStats
+}
+
+func newLimiter(config LimiterConfig) *limiter {
+	return &limiter{config: config, slots: make(chan struct{}, config.MaxConcurrent)}
+}
+
+// Stats returns the current statistics of the limiter.
+func (l *limiter) Stats() LimiterStats {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	stats := l.stats
+	stats.Active = len(l.slots)
+	return stats
+}
+
+// acquire waits until the request may be sent to Vault. If it returns no error, the caller must call release after the request.
+func (l *limiter) acquire(ctx context.Context) error {
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	l.mux.Lock()
+	if l.stats.Queued >= l.config.MaxQueued {
+		l.stats.Rejected++
+		l.mux.Unlock()
+		return fmt.Errorf("%w: queue is full", ErrBusy)
+	}
+	l.stats.Queued++
+	l.mux.Unlock()
+
+	start := time.Now()
+	timer := time.NewTimer(l.config.QueueTimeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case l.slots <- struct{}{}:
+	case <-timer.C:
+		err = fmt.Errorf("%w: waited %s in queue", ErrBusy, l.config.QueueTimeout)
+	case <-ctx.Done():
+		err = classifyError(ctx.Err())
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.stats.Queued--
+	l.stats.Waited++
+	l.stats.WaitTime += time.Since(start)
+	if errors.Is(err, ErrBusy) {
+		l.stats.Rejected++
+	}
+	return err
+}
+
+func (l *limiter) release() {
+	<-l.slots
+}
+
+type unlimitedKey struct{}
+
+// WithoutLimit returns a context of which the requests to Vault bypass the limit on concurrent requests.
+// It is meant for monitoring (e.g. health checks and metrics), which must not fail because the proxy is busy.
+func WithoutLimit(ctx context.Context) context.Context {
+	return context.WithValue(ctx, unlimitedKey{}, true)
+}
+
+func isUnlimited(ctx context.Context) bool {
+	unlimited, _ := ctx.Value(unlimitedKey{}).(bool)
+	return unlimited
+}
+
+// limitingClient is a vaultClient which limits the number of concurrent requests to the wrapped client.
+type limitingClient struct {
+	client  vaultClient
+	limiter *limiter
+}
+
+func (c limitingClient) ReadWithContext(ctx context.Context, path string) (*vaultapi.Secret, error) {
+	return c.do(ctx, func() (*vaultapi.Secret, error) {
+		return c.client.ReadWithContext(ctx, path)
+	})
+}
+
+func (c limitingClient) WriteWithContext(ctx context.Context, path string, data map[string]interface{}) (*vaultapi.Secret, error) {
+	return c.do(ctx, func() (*vaultapi.Secret, error) {
+		return c.client.WriteWithContext(ctx, path, data)
+	})
+}
+
+func (c limitingClient) ListWithContext(ctx context.Context, path string) (*vaultapi.Secret, error) {
+	return c.do(ctx, func() (*vaultapi.Secret, error) {
+		return c.client.ListWithContext(ctx, path)
+	})
+}
+
+func (c limitingClient) ReadWithDataWithContext(ctx context.Context, path string, data map[string][]string) (*vaultapi.Secret, error) {
+	return c.do(ctx, func() (*vaultapi.Secret, error) {
+		return c.client.ReadWithDataWithContext(ctx, path, data)
+	})
+}
+
+func (c limitingClient) DeleteWithContext(ctx context.Context, path string) (*vaultapi.Secret, error) {
+	return c.do(ctx, func() (*vaultapi.Secret, error) {
+		return c.client.DeleteWithContext(ctx, path)
+	})
+}
+
+func (c limitingClient) do(ctx context.Context, request func() (*vaultapi.Secret, error)) (*vaultapi.Secret, error) {
+	if isUnlimited(ctx) {
+		return request()
+	}
+	if err := c.limiter.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer c.limiter.release()
+	return request()
+}
@@ -0,0 +1,204 @@
+/*
+ * Copyright (C) 2023 Nuts community
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package vault
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/singleflight"
+)
+
+func TestLimitingClient(t *testing.T) {
+	ctx := context.Background()
+	config := LimiterConfig{MaxConcurrent: 2, MaxQueued: 1, QueueTimeout: time.Minute}
+	// startReads starts the given number of reads, which block until the returned function is called.
+	startReads := func(client limitingClient, slow slowVaultClient, count int) (func(), *sync.WaitGroup) {
+		wg := &sync.WaitGroup{}
+		for i := 0; i < count; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := client.ReadWithContext(ctx, storagePath(prefix, kid))
+				assert.NoError(t, err)
+			}()
+		}
+		return func() { close(slow.release) }, wg
+	}
+	// waitFor waits until the limiter reports the given number of active and queued requests.
+	waitFor := func(t *testing.T, l *limiter, active, queued int) {
+		require.Eventually(t, func() bool {
+			stats := l.Stats()
+			return stats.Active == active && stats.Queued == queued
+		}, time.Second, time.Millisecond)
+	}
+
+	t.Run("limits concurrent requests", func(t *testing.T) {
+		slow := newSlowVaultClient(time.Minute)
+		client := limitingClient{client: slow, limiter: newLimiter(config)}
+
+		release, wg := startReads(client, slow, 3)
+		waitFor(t, client.limiter, 2, 1)
+		assert.Equal(t, int64(2), slow.calls.Load())
+
+		release()
+		wg.Wait()
+		stats := client.limiter.Stats()
+		assert.Equal(t, int64(3), slow.calls.Load())
+		assert.Greater(t, stats.WaitTime, time.Duration(0))
+		assert.Equal(t, LimiterStats{Waited: 1, WaitTime: stats.WaitTime}, stats)
+	})
+	t.Run("rejects requests when the queue is full", func(t *testing.T) {
+		slow := newSlowVaultClient(time.Minute)
+		client := limitingClient{client: slow, limiter: newLimiter(config)}
+		release, wg := startReads(client, slow, 3)
+		defer wg.Wait()
+		defer release()
+		waitFor(t, client.limiter, 2, 1)
+
+		_, err := client.ReadWithContext(ctx, storagePath(prefix, kid))
+
+		assert.ErrorIs(t, err, ErrBusy)
+		assert.EqualError(t, err, "too many concurrent vault requests: queue is full")
+		assert.Equal(t, uint64(1), client.limiter.Stats().Rejected)
+	})
+	t.Run("rejects requests waiting too long", func(t *testing.T) {
+		slow := newSlowVaultClient(time.Minute)
+		client := limitingClient{client: slow, limiter: newLimiter(LimiterConfig{MaxConcurrent: 1, MaxQueued: 1, QueueTimeout: 10 * time.Millisecond})}
+		release, wg := startReads(client, slow, 1)
+		defer wg.Wait()
+		defer release()
+		waitFor(t, client.limiter, 1, 0)
+
+		_, err := client.ReadWithContext(ctx, storagePath(prefix, kid))
+
+		assert.ErrorIs(t, err, ErrBusy)
+		assert.EqualError(t, err, "too many concurrent vault requests: waited 10ms in queue")
+		stats := client.limiter.Stats()
+		assert.Equal(t, uint64(1), stats.Rejected)
+		assert.Equal(t, 0, stats.Queued)
+	})
+	t.Run("stops waiting when the context is done", func(t *testing.T) {
+		slow := newSlowVaultClient(time.Minute)
+		client := limitingClient{client: slow, limiter: newLimiter(LimiterConfig{MaxConcurrent: 1, MaxQueued: 1, QueueTimeout: time.Minute})}
+		release, wg := startReads(client, slow, 1)
+		defer wg.Wait()
+		defer release()
+		waitFor(t, client.limiter, 1, 0)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		_, err := client.ReadWithContext(ctx, storagePath(prefix, kid))
+
+		assert.ErrorIs(t, err, ErrTimeout)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Equal(t, uint64(0), client.limiter.Stats().Rejected)
+	})
+	t.Run("rejected requests are not retried and do not open the circuit breaker", func(t *testing.T) {
+		slow := newSlowVaultClient(time.Minute)
+		limiter := newLimiter(LimiterConfig{MaxConcurrent: 1, MaxQueued: 0, QueueTimeout: time.Minute})
+		release, wg := startReads(limitingClient{client: slow, limiter: limiter}, slow, 1)
+		defer wg.Wait()
+		defer release()
+		waitFor(t, limiter, 1, 0)
+		var delays []time.Duration
+		breaker := newCircuitBreaker(BreakerConfig{FailureThreshold: 1, OpenTimeout: time.Minute})
+		client := breakerClient{client: newTestRetryingClient(limitingClient{client: slow, limiter: limiter}, &delays), breaker: breaker}
+
+		_, err := client.ReadWithContext(ctx, storagePath(prefix, kid))
+
+		assert.ErrorIs(t, err, ErrBusy)
+		assert.Empty(t, delays)
+		assert.Equal(t, CircuitBreakerClosed, breaker.State())
+	})
+	t.Run("rejected probe does not close the circuit breaker", func(t *testing.T) {
+		slow := newSlowVaultClient(time.Minute)
+		limiter := newLimiter(LimiterConfig{MaxConcurrent: 1, MaxQueued: 0, QueueTimeout: time.Minute})
+		release, wg := startReads(limitingClient{client: slow, limiter: limiter}, slow, 1)
+		defer wg.Wait()
+		defer release()
+		waitFor(t, limiter, 1, 0)
+		now := time.Now()
+		breaker := newCircuitBreaker(BreakerConfig{FailureThreshold: 1, OpenTimeout: time.Minute})
+		breaker.now = func() time.Time { return now }
+		breaker.open()
+		now = now.Add(time.Minute)
+		client := breakerClient{client: limitingClient{client: slow, limiter: limiter}, breaker: breaker}
+
+		_, err := client.ReadWithContext(ctx, storagePath(prefix, kid))
+
+		assert.ErrorIs(t, err, ErrBusy)
+		assert.Equal(t, int64(1), slow.calls.Load(), "probe should not be sent to Vault")
+		assert.Equal(t, CircuitBreakerHalfOpen, breaker.State())
+		assert.NoError(t, breaker.allow(), "next request should be allowed as probe")
+	})
+}
+
+func TestLimitingClient_withoutLimit(t *testing.T) {
+	ctx := context.Background()
+	// newBusyStorage returns a KVStorage of which the limiter is busy with a request and doesn't let others wait.
+	newBusyStorage := func(t *testing.T) (KVStorage, func()) {
+		slow := newSlowVaultClient(time.Minute)
+		slow.store["auth/token/lookup-self"] = map[string]interface{}{"ttl": 3600}
+		limiter := newLimiter(LimiterConfig{MaxConcurrent: 1, MaxQueued: 0, QueueTimeout: time.Minute})
+		client := limitingClient{client: slow.lockingVaultClient, limiter: limiter}
+		wg := &sync.WaitGroup{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = limitingClient{client: slow, limiter: limiter}.ReadWithContext(ctx, storagePath(prefix, kid))
+		}()
+		require.Eventually(t, func() bool { return limiter.Stats().Active == 1 }, time.Second, time.Millisecond)
+		v := KVStorage{client: client, sys: activeVault, pathPrefix: prefix, limiter: limiter, flights: &singleflight.Group{}}
+		_, err := v.GetSecret(ctx, kid)
+		require.ErrorIs(t, err, ErrBusy)
+		return v, func() {
+			close(slow.release)
+			wg.Wait()
+		}
+	}
+
+	t.Run("health check bypasses the limit", func(t *testing.T) {
+		v, release := newBusyStorage(t)
+		defer release()
+
+		status, err := v.Ping(ctx)
+
+		assert.NoError(t, err)
+		assert.Equal(t, 1, status.Limiter.Active)
+	})
+	t.Run("requests without limit bypass the limit", func(t *testing.T) {
+		v, release := newBusyStorage(t)
+		defer release()
+
+		_, err := v.ListKeys(WithoutLimit(ctx))
+
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(1), v.limiter.Stats().Rejected, "only the limited request should be rejected")
+	})
+}
+
+func TestLimiterConfig_validate(t *testing.T) {
+	assert.NoError(t, DefaultLimiterConfig().validate())
+	assert.EqualError(t, LimiterConfig{MaxConcurrent: -1}.validate(), "maximum concurrent and queued requests can't be negative")
+	assert.EqualError(t, LimiterConfig{MaxConcurrent: 1}.validate(), "queue timeout must be positive")
+}
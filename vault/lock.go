@@ -0,0 +1,62 @@
+/*
+ * Copyright (C) 2023 Nuts community
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package vault
+
+import "sync"
+
+// writeLocks serializes writes to the same Vault path within this process.
+var writeLocks pathLocks
+
+// pathLocks is a set of mutexes keyed by path. Mutexes are removed when no longer in use,
+// so the set doesn't grow with every key that has ever been written.
+type pathLocks struct {
+	mutex sync.Mutex
+	locks map[string]*pathLock
+}
+
+type pathLock struct {
+	sync.Mutex
+	// references is the number of goroutines holding or waiting for the lock
+	references int
+}
+
+// lock acquires the lock for the given path, blocking until it is available. It returns the function to release it.
+func (p *pathLocks) lock(path string) func() {
+	p.mutex.Lock()
+	if p.locks == nil {
+		p.locks = map[string]*pathLock{}
+	}
+	lock, ok := p.locks[path]
+	if !ok {
+		lock = &pathLock{}
+		p.locks[path] = lock
+	}
+	lock.references++
+	p.mutex.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		p.mutex.Lock()
+		lock.references--
+		if lock.references == 0 {
+			delete(p.locks, path)
+		}
+		p.mutex.Unlock()
+	}
+}
@@ -0,0 +1,192 @@
+/*
+ * Copyright (C) 2023 Nuts community
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package vault
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "vault_proxy"
+
+// vaultRequestDuration and vaultRequestErrors are the metrics of the requests sent to Vault, per operation.
+var (
+	vaultRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "vault_request_duration_seconds",
+		Help:      "Duration of the requests to Vault, per operation (read, write, list or delete).",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+	vaultRequestErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "vault_request_errors_total",
+		Help:      "Number of failed requests to Vault, per operation (read, write, list or delete) and cause of the failure.",
+	}, []string{"operation", "cause"})
+)
+
+// RegisterMetrics registers the metrics of the requests to Vault.
+func RegisterMetrics(registerer prometheus.Registerer) error {
+	for _, collector := range []prometheus.Collector{vaultRequestDuration, vaultRequestErrors} {
+		if err := registerer.Register(collector); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// errorCause returns the label describing the cause of a (classified) error.
+func errorCause(err error) string {
+	causes := []struct {
+		err   error
+		label string
+	}{
+		{ErrSealed, "sealed"},
+		{ErrUnavailable, "unavailable"},
+		{ErrTimeout, "timeout"},
+		{ErrPermissionDenied, "permission_denied"},
+		{ErrRateLimited, "rate_limited"},
+		{ErrInvalidPath, "invalid_path"},
+		{context.Canceled, "canceled"},
+	}
+	for _, cause := range causes {
+		if errors.Is(err, cause.err) {
+			return cause.label
+		}
+	}
+	return "other"
+}
+
+// metricsClient is a vaultClient which records the duration and errors of the requests to the wrapped client.
+// It expects the errors of the wrapped client to be classified by classifyError.
+type metricsClient struct {
+	client vaultClient
+}
+
+func (c metricsClient) ReadWithContext(ctx context.Context, path string) (*vaultapi.Secret, error) {
+	return observe("read", func() (*vaultapi.Secret, error) {
+		return c.client.ReadWithContext(ctx, path)
+	})
+}
+
+func (c metricsClient) WriteWithContext(ctx context.Context, path string, data map[string]interface{}) (*vaultapi.Secret, error) {
+	return observe("write", func() (*vaultapi.Secret, error) {
+		return c.client.WriteWithContext(ctx, path, data)
+	})
+}
+
+func (c metricsClient) ListWithContext(ctx context.Context, path string) (*vaultapi.Secret, error) {
+	return observe("list", func() (*vaultapi.Secret, error) {
+		return c.client.ListWithContext(ctx, path)
+	})
+}
+
+func (c metricsClient) ReadWithDataWithContext(ctx context.Context, path string, data map[string][]string) (*vaultapi.Secret, error) {
+	return observe("read", func() (*vaultapi.Secret, error) {
+		return c.client.ReadWithDataWithContext(ctx, path, data)
+	})
+}
+
+func (c metricsClient) DeleteWithContext(ctx context.Context, path string) (*vaultapi.Secret, error) {
+	return observe("delete", func() (*vaultapi.Secret, error) {
+		return c.client.DeleteWithContext(ctx, path)
+	})
+}
+
+func observe(operation string, request func() (*vaultapi.Secret, error)) (*vaultapi.Secret, error) {
+	start := time.Now()
+	secret, err := request()
+	vaultRequestDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		vaultRequestErrors.WithLabelValues(operation, errorCause(err)).Inc()
+	}
+	return secret, err
+}
+
+var (
+	circuitBreakerStateDesc = prometheus.NewDesc(metricsNamespace+"_circuit_breaker_state",
+		"State of the circuit breaker in front of Vault, 1 for the current state.", []string{"state"}, nil)
+	activeRequestsDesc = prometheus.NewDesc(metricsNamespace+"_vault_requests_active",
+		"Number of requests currently sent to Vault.", nil, nil)
+	queuedRequestsDesc = prometheus.NewDesc(metricsNamespace+"_vault_requests_queued",
+		"Number of requests waiting for the maximum number of concurrent requests to Vault.", nil, nil)
+	rejectedRequestsDesc = prometheus.NewDesc(metricsNamespace+"_vault_requests_rejected_total",
+		"Number of requests rejected because too many requests were waiting or they waited too long.", nil, nil)
+	queueWaitDesc = prometheus.NewDesc(metricsNamespace+"_vault_requests_queue_wait_seconds_total",
+		"Total time requests waited for the maximum number of concurrent requests to Vault.", nil, nil)
+	queueWaitsDesc = prometheus.NewDesc(metricsNamespace+"_vault_requests_queued_total",
+		"Number of requests that waited for the maximum number of concurrent requests to Vault.", nil, nil)
+)
+
+// Describe implements prometheus.Collector for the state of the circuit breaker and limiter, if enabled.
+func (v KVStorage) Describe(ch chan<- *prometheus.Desc) {
+	prometheus.DescribeByCollect(v, ch)
+}
+
+// Collect implements prometheus.Collector for the state of the circuit breaker and limiter, if enabled.
+func (v KVStorage) Collect(ch chan<- prometheus.Metric) {
+	if v.breaker != nil {
+		state := v.breaker.State()
+		for _, s := range []string{CircuitBreakerClosed, CircuitBreakerOpen, CircuitBreakerHalfOpen} {
+			ch <- prometheus.MustNewConstMetric(circuitBreakerStateDesc, prometheus.GaugeValue, boolValue(s == state), s)
+		}
+	}
+	if v.limiter != nil {
+		stats := v.limiter.Stats()
+		ch <- prometheus.MustNewConstMetric(activeRequestsDesc, prometheus.GaugeValue, float64(stats.Active))
+		ch <- prometheus.MustNewConstMetric(queuedRequestsDesc, prometheus.GaugeValue, float64(stats.Queued))
+		ch <- prometheus.MustNewConstMetric(rejectedRequestsDesc, prometheus.CounterValue, float64(stats.Rejected))
+		ch <- prometheus.MustNewConstMetric(queueWaitsDesc, prometheus.CounterValue, float64(stats.Waited))
+		ch <- prometheus.MustNewConstMetric(queueWaitDesc, prometheus.CounterValue, stats.WaitTime.Seconds())
+	}
+}
+
+var (
+	cacheHitsDesc = prometheus.NewDesc(metricsNamespace+"_cache_hits_total",
+		"Number of secrets returned from the cache.", nil, nil)
+	cacheMissesDesc = prometheus.NewDesc(metricsNamespace+"_cache_misses_total",
+		"Number of secrets that had to be read from Vault.", nil, nil)
+	cacheStaleDesc = prometheus.NewDesc(metricsNamespace+"_cache_stale_total",
+		"Number of expired secrets returned from the cache because Vault was unavailable.", nil, nil)
+	cacheEntriesDesc = prometheus.NewDesc(metricsNamespace+"_cache_entries",
+		"Number of cached secrets.", nil, nil)
+)
+
+// Describe implements prometheus.Collector for the cache statistics.
+func (c *CachingStorage) Describe(ch chan<- *prometheus.Desc) {
+	prometheus.DescribeByCollect(c, ch)
+}
+
+// Collect implements prometheus.Collector for the cache statistics.
+func (c *CachingStorage) Collect(ch chan<- prometheus.Metric) {
+	stats := c.Stats()
+	ch <- prometheus.MustNewConstMetric(cacheHitsDesc, prometheus.CounterValue, float64(stats.Hits))
+	ch <- prometheus.MustNewConstMetric(cacheMissesDesc, prometheus.CounterValue, float64(stats.Misses))
+	ch <- prometheus.MustNewConstMetric(cacheStaleDesc, prometheus.CounterValue, float64(stats.Stale))
+	ch <- prometheus.MustNewConstMetric(cacheEntriesDesc, prometheus.GaugeValue, float64(c.Len()))
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright (C) 2023 Nuts community
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package vault
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsClient(t *testing.T) {
+	ctx := context.Background()
+	vaultRequestDuration.Reset()
+	vaultRequestErrors.Reset()
+	faulty := &faultyVaultClient{client: mockVaultClient{store: map[string]map[string]interface{}{}}, faults: []error{nil, permissionDenied, serviceUnavailable}}
+	client := metricsClient{client: faulty}
+
+	_, _ = client.WriteWithContext(ctx, "kv/key", map[string]interface{}{"key": "value"})
+	_, _ = client.ReadWithContext(ctx, "kv/key")
+	_, _ = client.ListWithContext(ctx, "kv")
+	_, _ = client.DeleteWithContext(ctx, "kv/key")
+
+	assert.Equal(t, 4, testutil.CollectAndCount(vaultRequestDuration))
+	assert.Equal(t, 1.0, testutil.ToFloat64(vaultRequestErrors.WithLabelValues("read", "permission_denied")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(vaultRequestErrors.WithLabelValues("list", "unavailable")))
+	assert.Equal(t, 2, testutil.CollectAndCount(vaultRequestErrors))
+}
+
+func TestErrorCause(t *testing.T) {
+	assert.Equal(t, "sealed", errorCause(classifyError(&vaultapi.ResponseError{StatusCode: 503, Errors: []string{"Vault is sealed"}})))
+	assert.Equal(t, "unavailable", errorCause(classifyError(connectionRefused)))
+	assert.Equal(t, "timeout", errorCause(classifyError(context.DeadlineExceeded)))
+	assert.Equal(t, "rate_limited", errorCause(classifyError(rateLimited)))
+	assert.Equal(t, "canceled", errorCause(context.Canceled))
+	assert.Equal(t, "other", errorCause(vaultError))
+}
+
+func TestKVStorage_Collect(t *testing.T) {
+	t.Run("circuit breaker and limiter", func(t *testing.T) {
+		breaker := newCircuitBreaker(BreakerConfig{FailureThreshold: 1, OpenTimeout: time.Minute})
+		breaker.open()
+		v := KVStorage{breaker: breaker, limiter: newLimiter(LimiterConfig{MaxConcurrent: 1, QueueTimeout: time.Second})}
+
+		err := testutil.CollectAndCompare(v, strings.NewReader(`
+# HELP vault_proxy_circuit_breaker_state State of the circuit breaker in front of Vault, 1 for the current state.
+# TYPE vault_proxy_circuit_breaker_state gauge
+vault_proxy_circuit_breaker_state{state="closed"} 0
+vault_proxy_circuit_breaker_state{state="half-open"} 0
+vault_proxy_circuit_breaker_state{state="open"} 1
+# HELP vault_proxy_vault_requests_active Number of requests currently sent to Vault.
+# TYPE vault_proxy_vault_requests_active gauge
+vault_proxy_vault_requests_active 0
+`), "vault_proxy_circuit_breaker_state", "vault_proxy_vault_requests_active")
+		assert.NoError(t, err)
+		assert.Equal(t, 8, testutil.CollectAndCount(v))
+	})
+	t.Run("disabled", func(t *testing.T) {
+		assert.Equal(t, 0, testutil.CollectAndCount(KVStorage{}))
+	})
+}
+
+func TestCachingStorage_Collect(t *testing.T) {
+	cache, _, _ := newTestCache(t, CacheConfig{TTL: time.Minute, MaxEntries: 10})
+	require.NoError(t, cache.StoreSecret(context.Background(), kid, secret))
+	_, _ = cache.GetSecret(context.Background(), kid)
+	_, _ = cache.GetSecret(context.Background(), kid)
+
+	registry := prometheus.NewPedanticRegistry()
+	require.NoError(t, registry.Register(cache))
+	err := testutil.GatherAndCompare(registry, strings.NewReader(`
+# HELP vault_proxy_cache_entries Number of cached secrets.
+# TYPE vault_proxy_cache_entries gauge
+vault_proxy_cache_entries 1
+# HELP vault_proxy_cache_hits_total Number of secrets returned from the cache.
+# TYPE vault_proxy_cache_hits_total counter
+vault_proxy_cache_hits_total 1
+# HELP vault_proxy_cache_misses_total Number of secrets that had to be read from Vault.
+# TYPE vault_proxy_cache_misses_total counter
+vault_proxy_cache_misses_total 1
+# HELP vault_proxy_cache_stale_total Number of expired secrets returned from the cache because Vault was unavailable.
+# TYPE vault_proxy_cache_stale_total counter
+vault_proxy_cache_stale_total 0
+`))
+	assert.NoError(t, err)
+}
@@ -0,0 +1,171 @@
+/*
+ * Copyright (C) 2023 Nuts community
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package vault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	"github.com/sirupsen/logrus"
+)
+
+// RetryConfig configures how Vault requests failing with a transient error are retried.
+type RetryConfig struct {
+	// MaxAttempts is the maximum number of attempts of a single Vault request, including the first one.
+	// A value of 1 or less disables retries.
+	MaxAttempts int
+	// InitialBackoff is the delay before the first retry, which doubles for every subsequent retry.
+	InitialBackoff time.Duration
+	// MaxBackoff limits the delay between retries.
+	MaxBackoff time.Duration
+	// Jitter is the fraction (0 to 1) of the delay which is randomized, to prevent clients from retrying in lockstep.
+	Jitter float64
+}
+
+// DefaultRetryConfig returns the default retry policy.
+func DefaultRetryConfig() RetryConfig {
+	return RetryConfig{
+		MaxAttempts:    3,
+		InitialBackoff: 250 * time.Millisecond,
+		MaxBackoff:     2 * time.Second,
+		Jitter:         0.2,
+	}
+}
+
+func (c RetryConfig) validate() error {
+	if c.InitialBackoff < 0 || c.MaxBackoff < 0 {
+		return errors.New("retry backoff can't be negative")
+	}
+	if c.Jitter < 0 || c.Jitter > 1 {
+		return fmt.Errorf("retry jitter must be between 0 and 1 (was %v)", c.Jitter)
+	}
+	return nil
+}
+
+// backoff returns the delay before the given retry (starting at 1).
+func (c RetryConfig) backoff(retry int) time.Duration {
+	delay := c.InitialBackoff
+	for i := 1; i < retry && delay < c.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > c.MaxBackoff {
+		delay = c.MaxBackoff
+	}
+	return delay - time.Duration(c.Jitter*rand.Float64()*float64(delay))
+}
+
+// retryingClient is a vaultClient which retries idempotent requests that fail with a transient error.
+// It expects the errors of the wrapped client to be classified by classifyError.
+type retryingClient struct {
+	client vaultClient
+	config RetryConfig
+	// sleep waits for the given duration or until the context is done, it can be replaced in tests.
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+func newRetryingClient(client vaultClient, config RetryConfig) retryingClient {
+	return retryingClient{client: client, config: config, sleep: sleep}
+}
+
+func (c retryingClient) ReadWithContext(ctx context.Context, path string) (*vaultapi.Secret, error) {
+	return c.do(ctx, "read", path, func() (*vaultapi.Secret, error) {
+		return c.client.ReadWithContext(ctx, path)
+	})
+}
+
+// WriteWithContext only retries writes which are idempotent: a create-only write (check-and-set 0) is not retried,
+// since it fails with a check-and-set mismatch when the failed attempt was processed by Vault after all.
+func (c retryingClient) WriteWithContext(ctx context.Context, path string, data map[string]interface{}) (*vaultapi.Secret, error) {
+	write := func() (*vaultapi.Secret, error) {
+		return c.client.WriteWithContext(ctx, path, data)
+	}
+	if isCheckAndSetWrite(data) {
+		return write()
+	}
+	return c.do(ctx, "write", path, write)
+}
+
+func (c retryingClient) ListWithContext(ctx context.Context, path string) (*vaultapi.Secret, error) {
+	return c.do(ctx, "list", path, func() (*vaultapi.Secret, error) {
+		return c.client.ListWithContext(ctx, path)
+	})
+}
+
+func (c retryingClient) ReadWithDataWithContext(ctx context.Context, path string, data map[string][]string) (*vaultapi.Secret, error) {
+	return c.do(ctx, "read", path, func() (*vaultapi.Secret, error) {
+		return c.client.ReadWithDataWithContext(ctx, path, data)
+	})
+}
+
+func (c retryingClient) DeleteWithContext(ctx context.Context, path string) (*vaultapi.Secret, error) {
+	return c.do(ctx, "delete", path, func() (*vaultapi.Secret, error) {
+		return c.client.DeleteWithContext(ctx, path)
+	})
+}
+
+func (c retryingClient) do(ctx context.Context, operation, path string, request func() (*vaultapi.Secret, error)) (*vaultapi.Secret, error) {
+	for attempt := 1; ; attempt++ {
+		secret, err := request()
+		if err == nil || attempt >= c.config.MaxAttempts || !isTransient(err) || ctx.Err() != nil {
+			return secret, err
+		}
+		delay := c.config.backoff(attempt)
+		logrus.WithError(err).Warnf("Vault %s of %s failed (attempt %d of %d), retrying in %s", operation, path, attempt, c.config.MaxAttempts, delay)
+		if c.sleep(ctx, delay) != nil {
+			// the context is done, return the error of the last attempt
+			return secret, err
+		}
+	}
+}
+
+// isTransient returns whether the (classified) error is likely to be resolved by retrying the request:
+// server errors, rate limiting and connection errors.
+func isTransient(err error) bool {
+	if errors.Is(err, ErrUnavailable) || errors.Is(err, ErrSealed) || errors.Is(err, ErrTimeout) || errors.Is(err, ErrRateLimited) {
+		return true
+	}
+	var responseError *vaultapi.ResponseError
+	return errors.As(err, &responseError) && responseError.StatusCode >= http.StatusInternalServerError
+}
+
+// isCheckAndSetWrite returns whether the write data contains a check-and-set option, making the write conditional.
+func isCheckAndSetWrite(data map[string]interface{}) bool {
+	options, ok := data["options"].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	_, ok = options["cas"]
+	return ok
+}
+
+// sleep waits for the given duration, or returns the error of the context if it's done earlier.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
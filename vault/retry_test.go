@@ -0,0 +1,231 @@
+/*
+ * Copyright (C) 2023 Nuts community
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package vault
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	"github.com/stretchr/testify/assert"
+)
+
+// faultyVaultClient injects faults into the calls to the wrapped client: each call fails with the next fault until there are none left.
+// A nil fault lets the call succeed.
+type faultyVaultClient struct {
+	client vaultClient
+	faults []error
+	// processed makes faulty calls reach the wrapped client before failing, like a request of which the response got lost.
+	processed bool
+	calls     int
+}
+
+func (f *faultyVaultClient) call(request func() (*vaultapi.Secret, error)) (*vaultapi.Secret, error) {
+	f.calls++
+	if len(f.faults) == 0 {
+		return request()
+	}
+	fault := f.faults[0]
+	f.faults = f.faults[1:]
+	if fault == nil {
+		return request()
+	}
+	if f.processed {
+		_, _ = request()
+	}
+	return nil, classifyError(fault)
+}
+
+func (f *faultyVaultClient) ReadWithContext(ctx context.Context, path string) (*vaultapi.Secret, error) {
+	return f.call(func() (*vaultapi.Secret, error) { return f.client.ReadWithContext(ctx, path) })
+}
+
+func (f *faultyVaultClient) WriteWithContext(ctx context.Context, path string, data map[string]interface{}) (*vaultapi.Secret, error) {
+	return f.call(func() (*vaultapi.Secret, error) { return f.client.WriteWithContext(ctx, path, data) })
+}
+
+func (f *faultyVaultClient) ListWithContext(ctx context.Context, path string) (*vaultapi.Secret, error) {
+	return f.call(func() (*vaultapi.Secret, error) { return f.client.ListWithContext(ctx, path) })
+}
+
+func (f *faultyVaultClient) ReadWithDataWithContext(ctx context.Context, path string, data map[string][]string) (*vaultapi.Secret, error) {
+	return f.call(func() (*vaultapi.Secret, error) { return f.client.ReadWithDataWithContext(ctx, path, data) })
+}
+
+func (f *faultyVaultClient) DeleteWithContext(ctx context.Context, path string) (*vaultapi.Secret, error) {
+	return f.call(func() (*vaultapi.Secret, error) { return f.client.DeleteWithContext(ctx, path) })
+}
+
+var (
+	serviceUnavailable = &vaultapi.ResponseError{StatusCode: 503, Errors: []string{"local node not active but active cluster node not found"}}
+	internalError      = &vaultapi.ResponseError{StatusCode: 500, Errors: []string{"internal error"}}
+	rateLimited        = &vaultapi.ResponseError{StatusCode: 429, Errors: []string{"rate limit quota exceeded"}}
+	permissionDenied   = &vaultapi.ResponseError{StatusCode: 403, Errors: []string{"permission denied"}}
+	connectionRefused  = &url.Error{Op: "Get", URL: "http://vault:8200/v1/kv/key", Err: errors.New("connection refused")}
+)
+
+// newTestRetryingClient returns a retryingClient which doesn't wait between retries, but records the delays.
+func newTestRetryingClient(client vaultClient, delays *[]time.Duration) retryingClient {
+	result := newRetryingClient(client, RetryConfig{MaxAttempts: 3, InitialBackoff: time.Second, MaxBackoff: 10 * time.Second})
+	result.sleep = func(ctx context.Context, d time.Duration) error {
+		*delays = append(*delays, d)
+		return ctx.Err()
+	}
+	return result
+}
+
+func TestRetryingClient(t *testing.T) {
+	ctx := context.Background()
+	store := map[string]map[string]interface{}{"kv/key": {"key": "value"}}
+
+	transientErrors := map[string]error{
+		"service unavailable": serviceUnavailable,
+		"internal error":      internalError,
+		"rate limited":        rateLimited,
+		"connection refused":  connectionRefused,
+	}
+	for name, fault := range transientErrors {
+		t.Run("retries on "+name, func(t *testing.T) {
+			var delays []time.Duration
+			faulty := &faultyVaultClient{client: mockVaultClient{store: store}, faults: []error{fault, fault}}
+
+			result, err := newTestRetryingClient(faulty, &delays).ReadWithContext(ctx, "kv/key")
+
+			assert.NoError(t, err)
+			assert.Equal(t, "value", result.Data["key"])
+			assert.Equal(t, 3, faulty.calls)
+			assert.Equal(t, []time.Duration{time.Second, 2 * time.Second}, delays)
+		})
+	}
+	t.Run("gives up after the maximum number of attempts", func(t *testing.T) {
+		var delays []time.Duration
+		faulty := &faultyVaultClient{client: mockVaultClient{store: store}, faults: []error{serviceUnavailable, serviceUnavailable, internalError}}
+
+		_, err := newTestRetryingClient(faulty, &delays).ListWithContext(ctx, "kv")
+
+		assert.ErrorIs(t, err, internalError)
+		assert.Equal(t, 3, faulty.calls)
+	})
+	t.Run("does not retry other errors", func(t *testing.T) {
+		var delays []time.Duration
+		faulty := &faultyVaultClient{client: mockVaultClient{store: store}, faults: []error{permissionDenied}}
+
+		_, err := newTestRetryingClient(faulty, &delays).DeleteWithContext(ctx, "kv/key")
+
+		assert.ErrorIs(t, err, ErrPermissionDenied)
+		assert.Equal(t, 1, faulty.calls)
+		assert.Empty(t, delays)
+	})
+	t.Run("retries idempotent writes", func(t *testing.T) {
+		var delays []time.Duration
+		faulty := &faultyVaultClient{client: mockVaultClient{store: map[string]map[string]interface{}{}}, faults: []error{connectionRefused}, processed: true}
+
+		_, err := newTestRetryingClient(faulty, &delays).WriteWithContext(ctx, "kv/key", map[string]interface{}{"key": "value"})
+
+		assert.NoError(t, err)
+		assert.Equal(t, 2, faulty.calls)
+	})
+	t.Run("does not retry check-and-set writes", func(t *testing.T) {
+		var delays []time.Duration
+		faulty := &faultyVaultClient{client: mockVaultClient{store: map[string]map[string]interface{}{}}, faults: []error{serviceUnavailable}}
+
+		_, err := newTestRetryingClient(faulty, &delays).WriteWithContext(ctx, "kv/data/key", map[string]interface{}{
+			"data":    map[string]interface{}{"key": "value"},
+			"options": map[string]interface{}{"cas": 0},
+		})
+
+		assert.ErrorIs(t, err, ErrUnavailable)
+		assert.Equal(t, 1, faulty.calls)
+	})
+	t.Run("stops when the context is done", func(t *testing.T) {
+		var delays []time.Duration
+		faulty := &faultyVaultClient{client: mockVaultClient{store: store}, faults: []error{serviceUnavailable, serviceUnavailable}}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := newTestRetryingClient(faulty, &delays).ReadWithContext(ctx, "kv/key")
+
+		assert.ErrorIs(t, err, serviceUnavailable)
+		assert.Equal(t, 1, faulty.calls)
+	})
+	t.Run("disabled", func(t *testing.T) {
+		faulty := &faultyVaultClient{client: mockVaultClient{store: store}, faults: []error{serviceUnavailable}}
+
+		_, err := newRetryingClient(faulty, RetryConfig{MaxAttempts: 1}).ReadWithContext(ctx, "kv/key")
+
+		assert.ErrorIs(t, err, serviceUnavailable)
+		assert.Equal(t, 1, faulty.calls)
+	})
+}
+
+func TestRetryingClient_KVStorage(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("storing a secret in KV version 2 does not result in a false conflict", func(t *testing.T) {
+		var delays []time.Duration
+		// the write is processed by Vault, but the connection fails before the response is received
+		faulty := &faultyVaultClient{client: mockVaultClient{store: map[string]map[string]interface{}{}}, faults: []error{connectionRefused}, processed: true}
+		v := KVStorage{client: newTestRetryingClient(faulty, &delays), pathPrefix: prefix, mountPath: prefix, version: KVVersion2}
+
+		err := v.StoreSecret(ctx, kid, secret)
+
+		assert.ErrorIs(t, err, ErrUnavailable)
+		assert.NotErrorIs(t, err, ErrKeyAlreadyExists)
+		assert.Equal(t, 1, faulty.calls)
+	})
+	t.Run("storing a secret in KV version 1 is retried", func(t *testing.T) {
+		var delays []time.Duration
+		// the lookup of the existing secret succeeds, the write fails the first time
+		faulty := &faultyVaultClient{client: mockVaultClient{store: map[string]map[string]interface{}{}}, faults: []error{nil, serviceUnavailable}}
+		v := KVStorage{client: newTestRetryingClient(faulty, &delays), pathPrefix: prefix}
+
+		assert.NoError(t, v.StoreSecret(ctx, kid, secret))
+		assert.Equal(t, 3, faulty.calls)
+		result, err := v.GetSecret(ctx, kid)
+		assert.NoError(t, err)
+		assert.Equal(t, secret, result)
+	})
+}
+
+func TestRetryConfig_backoff(t *testing.T) {
+	config := RetryConfig{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+
+	assert.Equal(t, 100*time.Millisecond, config.backoff(1))
+	assert.Equal(t, 200*time.Millisecond, config.backoff(2))
+	assert.Equal(t, 800*time.Millisecond, config.backoff(4))
+	assert.Equal(t, time.Second, config.backoff(5))
+	assert.Equal(t, time.Second, config.backoff(100))
+
+	t.Run("jitter", func(t *testing.T) {
+		config.Jitter = 0.5
+		for i := 0; i < 100; i++ {
+			delay := config.backoff(2)
+			assert.LessOrEqual(t, delay, 200*time.Millisecond)
+			assert.GreaterOrEqual(t, delay, 100*time.Millisecond)
+		}
+	})
+}
+
+func TestRetryConfig_validate(t *testing.T) {
+	assert.NoError(t, DefaultRetryConfig().validate())
+	assert.EqualError(t, RetryConfig{InitialBackoff: -1}.validate(), "retry backoff can't be negative")
+	assert.EqualError(t, RetryConfig{Jitter: 1.5}.validate(), "retry jitter must be between 0 and 1 (was 1.5)")
+}
@@ -0,0 +1,87 @@
+/*
+ * Copyright (C) 2023 Nuts community
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package vault
+
+import (
+	"context"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/nuts-foundation/hashicorp-vault-proxy/vault"
+
+// tracingClient is a vaultClient which starts a span for every request to the wrapped client.
+// The span only describes the operation: the path contains the key, and the errors may contain the path.
+type tracingClient struct {
+	client vaultClient
+	tracer trace.Tracer
+}
+
+func newTracingClient(client vaultClient) tracingClient {
+	return tracingClient{client: client, tracer: otel.Tracer(tracerName)}
+}
+
+func (c tracingClient) ReadWithContext(ctx context.Context, path string) (*vaultapi.Secret, error) {
+	return c.trace(ctx, "read", func(ctx context.Context) (*vaultapi.Secret, error) {
+		return c.client.ReadWithContext(ctx, path)
+	})
+}
+
+func (c tracingClient) WriteWithContext(ctx context.Context, path string, data map[string]interface{}) (*vaultapi.Secret, error) {
+	return c.trace(ctx, "write", func(ctx context.Context) (*vaultapi.Secret, error) {
+		return c.client.WriteWithContext(ctx, path, data)
+	})
+}
+
+func (c tracingClient) ListWithContext(ctx context.Context, path string) (*vaultapi.Secret, error) {
+	return c.trace(ctx, "list", func(ctx context.Context) (*vaultapi.Secret, error) {
+		return c.client.ListWithContext(ctx, path)
+	})
+}
+
+func (c tracingClient) ReadWithDataWithContext(ctx context.Context, path string, data map[string][]string) (*vaultapi.Secret, error) {
+	return c.trace(ctx, "read", func(ctx context.Context) (*vaultapi.Secret, error) {
+		return c.client.ReadWithDataWithContext(ctx, path, data)
+	})
+}
+
+func (c tracingClient) DeleteWithContext(ctx context.Context, path string) (*vaultapi.Secret, error) {
+	return c.trace(ctx, "delete", func(ctx context.Context) (*vaultapi.Secret, error) {
+		return c.client.DeleteWithContext(ctx, path)
+	})
+}
+
+func (c tracingClient) trace(ctx context.Context, operation string, request func(ctx context.Context) (*vaultapi.Secret, error)) (*vaultapi.Secret, error) {
+	ctx, span := c.tracer.Start(ctx, "vault "+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("vault.operation", operation)),
+	)
+	defer span.End()
+	secret, err := request(ctx)
+	if err != nil {
+		// only the cause is recorded, the error message may contain the key
+		cause := errorCause(err)
+		span.SetAttributes(attribute.String("error.type", cause))
+		span.SetStatus(codes.Error, cause)
+	}
+	return secret, err
+}
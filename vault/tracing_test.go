@@ -0,0 +1,91 @@
+/*
+ * Copyright (C) 2023 Nuts community
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package vault
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracingClient(t *testing.T) {
+	// newTracedStorage returns a KVStorage of which the Vault requests are traced by the returned exporter.
+	newTracedStorage := func(faults ...error) (KVStorage, *tracetest.InMemoryExporter, *sdktrace.TracerProvider) {
+		exporter := tracetest.NewInMemoryExporter()
+		provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+		client := &faultyVaultClient{client: mockVaultClient{store: map[string]map[string]interface{}{}}, faults: faults}
+		storage := KVStorage{client: tracingClient{client: client, tracer: provider.Tracer(tracerName)}, pathPrefix: prefix}
+		return storage, exporter, provider
+	}
+
+	t.Run("traces requests as child of the caller", func(t *testing.T) {
+		storage, exporter, provider := newTracedStorage()
+		ctx, parent := provider.Tracer("test").Start(context.Background(), "parent")
+
+		require.NoError(t, storage.StoreSecret(ctx, kid, secret))
+		_, err := storage.GetSecret(ctx, kid)
+		require.NoError(t, err)
+		parent.End()
+
+		spans := exporter.GetSpans()
+		var names []string
+		for _, span := range spans[:len(spans)-1] {
+			names = append(names, span.Name)
+			assert.Equal(t, parent.SpanContext().SpanID(), span.Parent.SpanID())
+			assert.Equal(t, codes.Unset, span.Status.Code)
+		}
+		assert.Equal(t, []string{"vault read", "vault write", "vault read"}, names)
+	})
+	t.Run("records the cause of errors", func(t *testing.T) {
+		storage, exporter, _ := newTracedStorage(connectionRefused)
+
+		_, err := storage.GetSecret(context.Background(), kid)
+		require.ErrorIs(t, err, ErrUnavailable)
+
+		spans := exporter.GetSpans()
+		require.Len(t, spans, 1)
+		assert.Equal(t, codes.Error, spans[0].Status.Code)
+		assert.Equal(t, "unavailable", spans[0].Status.Description)
+		assert.Empty(t, spans[0].Events)
+	})
+	t.Run("spans don't contain keys or secrets", func(t *testing.T) {
+		storage, exporter, _ := newTracedStorage(nil, nil, connectionRefused)
+		ctx := context.Background()
+
+		require.NoError(t, storage.StoreSecret(ctx, kid, secret))
+		_, _ = storage.GetSecret(ctx, kid)
+		_, _ = storage.ListKeys(ctx)
+
+		for _, span := range exporter.GetSpans() {
+			texts := []string{span.Name, span.Status.Description}
+			for _, attr := range span.Attributes {
+				texts = append(texts, attr.Value.Emit())
+			}
+			for _, text := range texts {
+				assert.False(t, strings.Contains(text, kid), "span %s contains the key: %s", span.Name, text)
+				assert.False(t, strings.Contains(text, string(secret)), "span %s contains the secret: %s", span.Name, text)
+			}
+		}
+	})
+}
@@ -18,23 +18,92 @@
 package vault
 
 import (
+	"context"
 	"errors"
+	"time"
 )
 
 // ErrNotFound indicates that the specified crypto storage entry couldn't be found.
 var ErrNotFound = errors.New("key not found")
 var ErrKeyAlreadyExists = errors.New("key already exists")
 
+// ErrSealed indicates that Vault is sealed and can't serve requests until it is unsealed.
+var ErrSealed = errors.New("vault is sealed")
+
+// ErrUnavailable indicates that Vault can't be reached or isn't able to serve requests at the moment.
+var ErrUnavailable = errors.New("vault is unavailable")
+
+// ErrPermissionDenied indicates that the Vault token isn't allowed to perform the operation.
+var ErrPermissionDenied = errors.New("permission denied by vault")
+
+// ErrRateLimited indicates that Vault rejected the request because a rate limit quota was exceeded.
+var ErrRateLimited = errors.New("rate limited by vault")
+
+// ErrInvalidPath indicates that Vault doesn't support the requested path, e.g. because the key results in an invalid path.
+var ErrInvalidPath = errors.New("invalid vault path")
+
+// ErrTimeout indicates that Vault didn't respond in time.
+var ErrTimeout = errors.New("vault request timed out")
+
+// ErrCircuitOpen indicates that the request wasn't sent to Vault because the circuit breaker is open after repeated failures.
+// It is always returned together with ErrUnavailable.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// ErrBusy indicates that the request wasn't sent to Vault because the maximum number of concurrent requests was reached
+// and too many requests were already waiting, or it waited too long.
+var ErrBusy = errors.New("too many concurrent vault requests")
+
+// ErrStale indicates that the secret could not be read from Vault because it is unavailable, and an expired value from the cache is returned instead.
+// Unlike other errors, it is returned together with the (stale) secret.
+var ErrStale = errors.New("serving stale secret")
+
+// States of the Vault server as reported in Status.
+const (
+	VaultStateActive             = "active"
+	VaultStateStandby            = "standby"
+	VaultStatePerformanceStandby = "performance standby"
+	VaultStateSealed             = "sealed"
+	VaultStateUninitialized      = "uninitialized"
+	VaultStateUnreachable        = "unreachable"
+)
+
+// States of the circuit breaker as reported in Status.
+const (
+	CircuitBreakerClosed   = "closed"
+	CircuitBreakerOpen     = "open"
+	CircuitBreakerHalfOpen = "half-open"
+)
+
 // Storage interface containing functions for storing and retrieving keys.
+// The context of each call is passed to Vault, so cancelling it (e.g. when the client disconnects) aborts the Vault requests.
 type Storage interface {
-	// Ping checks if the server is available and the credentials are correct.
-	Ping() error
+	// Ping checks if the server is available and the credentials are correct, and returns the status of the backend.
+	Ping(ctx context.Context) (Status, error)
 	// GetSecret from the storage backend and return its value.
-	GetSecret(key string) ([]byte, error)
+	// If the error wraps ErrStale, the returned value is a previously read value which may be outdated.
+	GetSecret(ctx context.Context, key string) ([]byte, error)
 	// StoreSecret stores the secret under the key in the storage backend.
-	StoreSecret(key string, value []byte) error
+	StoreSecret(ctx context.Context, key string, value []byte) error
 	// DeleteSecret the key under the given key in the storage backend.
-	DeleteSecret(key string) error
+	DeleteSecret(ctx context.Context, key string) error
 	// ListKeys returns a list of all keys in the storage backend.
-	ListKeys() ([]string, error)
+	ListKeys(ctx context.Context) ([]string, error)
+	// MissingCapabilities returns the capabilities the credentials lack to use the storage backend, e.g. due to an incorrect policy.
+	MissingCapabilities(ctx context.Context) ([]string, error)
+}
+
+// Status describes the state of the storage backend as observed by Ping.
+type Status struct {
+	// VaultState is the state of the Vault server (one of the VaultState constants). It is empty if it isn't known.
+	VaultState string
+	// TokenTTL is the remaining time-to-live of the Vault token. It is zero if the token does not expire.
+	TokenTTL time.Duration
+	// TokenRenewable indicates whether the Vault token can be renewed.
+	TokenRenewable bool
+	// TokenRemainingUses is the number of remaining uses of the Vault token. It is zero if the number of uses is unlimited.
+	TokenRemainingUses int
+	// CircuitBreaker is the state of the circuit breaker (one of the CircuitBreaker constants). It is empty if the circuit breaker is disabled.
+	CircuitBreaker string
+	// Limiter describes the concurrent requests to Vault. It is nil if the number of concurrent requests isn't limited.
+	Limiter *LimiterStats
 }